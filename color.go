@@ -0,0 +1,142 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// fcolor は各チャンネルを 0..1 の浮動小数点で表した色 (アルファ乗算済み)。
+// 平均や後処理の途中で 8bit に丸めず、最後に一度だけ変換するために使う。
+// サンプルの色は sRGB の値で、平均する前に線形光の値に変換する。floatImage の中は線形光の値になる。
+type fcolor struct {
+	r, g, b, a float64
+}
+
+func toFColor(c color.Color) fcolor {
+	r, g, b, a := c.RGBA()
+	return fcolor{
+		r: float64(r) / 0xffff,
+		g: float64(g) / 0xffff,
+		b: float64(b) / 0xffff,
+		a: float64(a) / 0xffff,
+	}
+}
+
+// sRGB の色を線形光の色に変換する。アルファは変換しない。
+func (c fcolor) toLinear() fcolor {
+	if c.a <= 0 {
+		return fcolor{}
+	}
+	return fcolor{
+		r: srgbToLinear(c.r/c.a) * c.a,
+		g: srgbToLinear(c.g/c.a) * c.a,
+		b: srgbToLinear(c.b/c.a) * c.a,
+		a: c.a,
+	}
+}
+
+// encoder は線形光の色を 8bit の色に変換する最後の段の設定
+type encoder struct {
+	// 出力ガンマ (OutputGamma を参照)
+	gamma float64
+	// 丸める前に 4×4 の Bayer 行列で ±0.5 段階の閾値をずらし、グラデーションの縞を目立たなくする
+	dither bool
+}
+
+// 4×4 の Bayer 行列
+var bayer4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// 画像上の位置 (x, y) にある線形光の色を符号化して 8bit の色に変換する。
+// 範囲外の値はここで初めて切り詰められる。ブルームなどで色がアルファを超えていても、
+// アルファを掛け直す前に切り詰めるので、結果は正しいアルファ乗算済みの色になる。
+func (e encoder) encode(c fcolor, x, y int) color.RGBA {
+	if c.a <= 0 {
+		return color.RGBA{}
+	}
+	var bias float64
+	if e.dither {
+		bias = ((bayer4[y&3][x&3]+0.5)/16 - 0.5) / 255
+	}
+	alpha := math.Min(c.a, 1)
+	a := toUint8(alpha)
+	ch := func(v float64) uint8 {
+		straight := math.Max(0, math.Min(v/c.a, 1))
+		return min(toUint8(encodeGamma(straight, e.gamma)*alpha+bias), a)
+	}
+	return color.RGBA{R: ch(c.r), G: ch(c.g), B: ch(c.b), A: a}
+}
+
+// 線形光の値を符号化する。gamma が 0 以下なら sRGB の変換式、それ以外は 1/gamma 乗を使う。
+func encodeGamma(v, gamma float64) float64 {
+	if gamma <= 0 {
+		return linearToSRGB(v)
+	}
+	return math.Pow(max(v, 0), 1/gamma)
+}
+
+// floatImage は後処理が終わるまで色を浮動小数点のまま保持するバッファ
+type floatImage struct {
+	w, h int
+	pix  []fcolor
+}
+
+func newFloatImage(w, h int) *floatImage {
+	return &floatImage{w: w, h: h, pix: make([]fcolor, w*h)}
+}
+
+func (f *floatImage) at(x, y int) fcolor {
+	return f.pix[y*f.w+x]
+}
+
+func (f *floatImage) set(x, y int, c fcolor) {
+	f.pix[y*f.w+x] = c
+}
+
+// e で符号化して 8bit の画像に変換する
+func (f *floatImage) toRGBA(e encoder) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, f.w, f.h))
+	f.drawInto(img, image.Point{}, e)
+	return img
+}
+
+// dst の origin を左上とする領域に、e で符号化しながら書き込む
+func (f *floatImage) drawInto(dst *image.RGBA, origin image.Point, e encoder) {
+	for y := 0; y < f.h; y++ {
+		for x := 0; x < f.w; x++ {
+			dst.SetRGBA(origin.X+x, origin.Y+y, e.encode(f.at(x, y), x, y))
+		}
+	}
+}
+
+// sRGB の値 (0..1) を線形光の値に変換する
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// 線形光の値 (0..1) を sRGB の値に変換する
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// 0..1 の値を 8bit に丸める
+func toUint8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	return uint8(v*255 + 0.5)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAverageColorsDoesNotClipIntermediates(t *testing.T) {
+	// 1 を超える値も途中では切り詰めない
+	c := averageColors([]fcolor{{r: 2, a: 1}, {a: 1}}, false)
+	if math.Abs(c.r-1) > 1e-12 {
+		t.Errorf("average of 2 and 0 = %g, want 1", c.r)
+	}
+
+	// 8bit では 0 に丸められる小さな値も、平均するまで残る
+	colors := make([]fcolor, 1000)
+	for i := range colors {
+		colors[i] = fcolor{r: 0.001, a: 1}
+	}
+	if c := averageColors(colors, false); math.Abs(c.r-0.001) > 1e-12 {
+		t.Errorf("average of 0.001 = %g, want 0.001", c.r)
+	}
+}
+
+func TestBloomKeepsValuesAboveOneUntilEncoding(t *testing.T) {
+	img := newFloatImage(3, 1)
+	for x := range 3 {
+		img.set(x, 0, fcolor{1, 1, 1, 1})
+	}
+	applyBloom(img, 0.5, 1, 1)
+	if c := img.at(1, 0); c.r <= 1 {
+		t.Errorf("bloomed white = %g, want above 1 before encoding", c.r)
+	}
+	// 符号化で初めて 255 に切り詰める
+	if c := img.toRGBA(encoder{}).RGBAAt(1, 0); c.R != 255 || c.A != 255 {
+		t.Errorf("encoded bloomed white = %v, want 255", c)
+	}
+}
+
+func TestSRGBRoundTrip(t *testing.T) {
+	for i := 0; i <= 255; i++ {
+		v := float64(i) / 255
+		if got := linearToSRGB(srgbToLinear(v)); math.Abs(got-v) > 1e-9 {
+			t.Errorf("sRGB %g round-trips to %g", v, got)
+		}
+	}
+}
+
+func TestKahanSumIsMoreAccurate(t *testing.T) {
+	// 1 に 1e-16 を 100 万回足す。素朴な加算では 1 のまま変わらない。
+	const n, tiny = 1000000, 1e-16
+	want := 1 + n*tiny
+
+	var k kahanSum
+	k.add(1)
+	naive := 1.0
+	for range n {
+		k.add(tiny)
+		naive += tiny
+	}
+	if errK, errNaive := math.Abs(k.sum-want), math.Abs(naive-want); errK >= errNaive || errK > 1e-15 {
+		t.Errorf("compensated error %g, naive error %g", errK, errNaive)
+	}
+
+	// 平均でも同じ精度が保たれる
+	colors := []fcolor{{r: 1, a: 1}}
+	for range 999 {
+		colors = append(colors, fcolor{r: tiny, a: 1})
+	}
+	if got, want := averageColors(colors, true).r, (1+999*tiny)/1000; math.Abs(got-want) > 1e-18 {
+		t.Errorf("average = %.20g, want %.20g", got, want)
+	}
+}
+
+func TestOutputGammaMidtones(t *testing.T) {
+	mid := fcolor{0.5, 0.5, 0.5, 1}
+	for _, tc := range []struct {
+		gamma float64
+		want  uint8
+	}{
+		{0, 188},   // sRGB の変換式
+		{1, 128},   // 線形のまま
+		{2.2, 186}, // 0.5^(1/2.2) = 0.73
+		{1.8, 174}, // 0.5^(1/1.8) = 0.68
+	} {
+		if got := (encoder{gamma: tc.gamma}).encode(mid, 0, 0).R; got != tc.want {
+			t.Errorf("OutputGamma %g encodes linear 0.5 as %d, want %d", tc.gamma, got, tc.want)
+		}
+	}
+
+	// 完全な黒と白は出力ガンマによらない
+	for _, gamma := range []float64{0, 1, 2.2} {
+		e := encoder{gamma: gamma}
+		if b, w := e.encode(fcolor{a: 1}, 0, 0), e.encode(fcolor{1, 1, 1, 1}, 0, 0); b.R != 0 || w.R != 255 {
+			t.Errorf("OutputGamma %g encodes black as %d and white as %d", gamma, b.R, w.R)
+		}
+	}
+}
+
+func TestOutputGammaChangesRender(t *testing.T) {
+	p := testParameters(24, 24)
+	srgb := mustGenerate(t, p)
+	p.RenderOpts.OutputGamma = 1
+	linear := mustGenerate(t, p)
+
+	// 線形のまま書き出すと中間調が暗くなる
+	var darker int
+	for i := range srgb.Pix {
+		if i%4 != 3 && linear.Pix[i] > srgb.Pix[i] {
+			t.Fatalf("byte %d is brighter with OutputGamma 1 (%d > %d)", i, linear.Pix[i], srgb.Pix[i])
+		}
+		if linear.Pix[i] < srgb.Pix[i] {
+			darker++
+		}
+	}
+	if darker == 0 {
+		t.Error("OutputGamma 1 did not darken any midtone")
+	}
+}
+
+// 緩やかなグラデーションを符号化し、4×4 のブロックで平均した値と本来の値の差の平均を返す。
+// 縞 (バンディング) があると、ブロックの平均が本来の値から最大で半段ずれる。
+func bandingError(dither bool) float64 {
+	const w, h = 256, 16
+	img := newFloatImage(w, h)
+	want := func(x int) float64 { return 0.2 + 0.02*float64(x)/w } // 線形光で 8bit の数段分
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := want(x)
+			img.set(x, y, fcolor{v, v, v, 1})
+		}
+	}
+	out := img.toRGBA(encoder{dither: dither})
+
+	var sum float64
+	var blocks int
+	for by := 0; by < h; by += 4 {
+		for bx := 0; bx < w; bx += 4 {
+			var avg, target float64
+			for y := by; y < by+4; y++ {
+				for x := bx; x < bx+4; x++ {
+					avg += float64(out.RGBAAt(x, y).R) / 16
+					target += linearToSRGB(want(x)) * 255 / 16
+				}
+			}
+			sum += math.Abs(avg - target)
+			blocks++
+		}
+	}
+	return sum / float64(blocks)
+}
+
+func TestDitherReducesBanding(t *testing.T) {
+	plain, dithered := bandingError(false), bandingError(true)
+	if dithered*2 > plain {
+		t.Errorf("banding error %g with dither, %g without; want it at least halved", dithered, plain)
+	}
+}
+
+func TestAverageColorsStraightAndPremultiplied(t *testing.T) {
+	near := func(a, b fcolor) bool {
+		return math.Abs(a.r-b.r) < 1e-12 && math.Abs(a.g-b.g) < 1e-12 &&
+			math.Abs(a.b-b.b) < 1e-12 && math.Abs(a.a-b.a) < 1e-12
+	}
+	// 不透明な赤と、アルファ 0.5 の青 (どちらもアルファ乗算済み)
+	colors := []fcolor{{r: 1, a: 1}, {b: 0.5, a: 0.5}}
+
+	// 色を戻してから平均すると (0.5, 0, 0.5)、平均のアルファ 0.75 を掛け直す
+	if got, want := averageColors(colors, false), (fcolor{r: 0.375, b: 0.375, a: 0.75}); !near(got, want) {
+		t.Errorf("straight average = %+v, want %+v", got, want)
+	}
+	// 乗算済みのまま平均すると、半透明の青の寄与はその分小さい
+	if got, want := averageColors(colors, true), (fcolor{r: 0.5, b: 0.25, a: 0.75}); !near(got, want) {
+		t.Errorf("premultiplied average = %+v, want %+v", got, want)
+	}
+
+	// 不透明なサンプルだけなら両者は一致する
+	opaque := []fcolor{{r: 1, a: 1}, {g: 0.2, b: 0.6, a: 1}}
+	if a, b := averageColors(opaque, false), averageColors(opaque, true); !near(a, b) {
+		t.Errorf("opaque samples: straight %+v, premultiplied %+v", a, b)
+	}
+}
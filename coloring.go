@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// ColoringMode は脱出したサンプルの色の決め方を表す
+type ColoringMode int
+
+const (
+	// 脱出までの反復回数で色を決める (Palette または組み込みの配色)
+	ColoringEscapeTime ColoringMode = iota
+	// 脱出した時点の値の虚部が正か負かで DecompositionColors の2色に塗り分ける (二分分解)
+	ColoringBinaryDecomposition
+	// 軌道が実軸・虚軸に最も近づいた距離で茎のような細い構造を明るく描く (ピックオーバーの茎)。
+	// 下地には反復回数による色を使う。設定は RenderOpts.Stalks を参照。
+	ColoringPickoverStalks
+	// 距離推定から求めた境界までの距離に応じて減衰する光で境界線を描く (ネオン風)。
+	// ブルームと違い、画像ではなく距離から解析的に求める。設定は RenderOpts.Glow を参照。
+	ColoringDistanceGlow
+	// 脱出した時点の値の偏角で 2π を len(DecompositionColors) 等分した扇形のどれに入るかを決め、
+	// その番号の色で塗る (扇形分解)。偏角 0 から反時計回りに 0, 1, ... 番になる。
+	ColoringSectorDecomposition
+)
+
+// 二分分解の色を返す
+func (g *Generator) binaryDecompositionColor(s Sample) fcolor {
+	colors := g.params.RenderOpts.DecompositionColors
+	if imag(s.Z) >= 0 {
+		return toFColor(colors[0])
+	}
+	return toFColor(colors[1])
+}
+
+// 扇形分解の色を返す
+func (g *Generator) sectorDecompositionColor(s Sample) fcolor {
+	colors := g.params.RenderOpts.DecompositionColors
+	arg := cmplx.Phase(s.Z)
+	if arg < 0 {
+		arg += 2 * math.Pi
+	}
+	k := int(arg / (2 * math.Pi) * float64(len(colors)))
+	return toFColor(colors[min(k, len(colors)-1)])
+}
+
+// ピックオーバーの茎の色を返す。茎の上は白く、下地は反復回数による色になる。
+func (g *Generator) pickoverStalksColor(s Sample, c colorizer) fcolor {
+	w := max(0, 1-s.trap/g.params.RenderOpts.Stalks.Width)
+	return mix(g.escapeTimeColor(s, c), fcolor{r: 1, g: 1, b: 1, a: 1}, w)
+}
+
+// 茎の距離を追跡するかどうかと、s から反復を再開するときの距離の初期値を返す
+func (g *Generator) startTrap(s Sample) (bool, float64) {
+	if g.params.RenderOpts.Coloring != ColoringPickoverStalks {
+		return false, 0
+	}
+	if s.N == 0 {
+		return true, math.Inf(1)
+	}
+	return true, s.trap
+}
+
+// 軌道上の点 v と座標軸との重み付き距離を返す
+func (g *Generator) stalkDistance(v complex128) float64 {
+	st := g.params.RenderOpts.Stalks
+	d := math.Inf(1)
+	if st.RealWeight > 0 {
+		d = math.Abs(imag(v)) / st.RealWeight
+	}
+	if st.ImagWeight > 0 {
+		d = min(d, math.Abs(real(v))/st.ImagWeight)
+	}
+	return d
+}
+
+// 境界の光の色を返す。距離が推定できないサンプルは背景の黒になる。
+func (g *Generator) distanceGlowColor(s Sample) fcolor {
+	distance, ok := g.boundaryDistance(s)
+	if !ok {
+		return fcolor{a: 1}
+	}
+	intensity := math.Exp(-distance / g.params.RenderOpts.Glow.Width)
+	return mix(fcolor{a: 1}, toFColor(g.params.RenderOpts.Glow.Color), intensity)
+}
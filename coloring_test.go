@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"image/color"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestBinaryDecompositionUsesTwoColors(t *testing.T) {
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	p := testParameters(40, 40)
+	p.RenderOpts.SubPixelSamples = 1
+	p.RenderOpts.Coloring = ColoringBinaryDecomposition
+	p.RenderOpts.DecompositionColors = []color.RGBA{red, blue}
+	g, f := mustCompute(t, p)
+	img := g.Colorize(f, nil)
+
+	counts := make(map[color.RGBA]int)
+	for py := 0; py < 40; py++ {
+		for px := 0; px < 40; px++ {
+			if f.PixelSamples(px, py)[0].Escaped {
+				counts[img.RGBAAt(px, py)]++
+			}
+		}
+	}
+	if len(counts) != 2 || counts[red] == 0 || counts[blue] == 0 {
+		t.Errorf("exterior colors = %v, want only %v and %v", counts, red, blue)
+	}
+}
+
+func TestSectorDecompositionUsesFourColors(t *testing.T) {
+	colors := []color.RGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}, {R: 255, G: 255, A: 255}}
+	p := testParameters(40, 40)
+	p.RenderOpts.SubPixelSamples = 1
+	p.RenderOpts.Coloring = ColoringSectorDecomposition
+	p.RenderOpts.DecompositionColors = colors
+	g, f := mustCompute(t, p)
+	img := g.Colorize(f, nil)
+
+	counts := make(map[color.RGBA]int)
+	for py := 0; py < 40; py++ {
+		for px := 0; px < 40; px++ {
+			s := f.PixelSamples(px, py)[0]
+			if !s.Escaped {
+				continue
+			}
+			// 偏角から求めた扇形の番号の色になる
+			arg := math.Atan2(imag(s.Z), real(s.Z))
+			if arg < 0 {
+				arg += 2 * math.Pi
+			}
+			want := colors[min(int(arg/(math.Pi/2)), 3)]
+			if got := img.RGBAAt(px, py); got != want {
+				t.Fatalf("pixel (%d, %d) with argument %g = %v, want %v", px, py, arg, got, want)
+			}
+			counts[want]++
+		}
+	}
+	if len(counts) != 4 {
+		t.Errorf("exterior colors = %v, want all four sector colors", counts)
+	}
+}
+
+func TestPickoverStalksBrightenNearAxes(t *testing.T) {
+	p := testParameters(64, 64)
+	p.RenderOpts.SubPixelSamples = 1
+	p.RenderOpts.Coloring = ColoringPickoverStalks
+	p.RenderOpts.Stalks.Width = 0.02
+	g, f := mustCompute(t, p)
+	stalks := g.Colorize(f, nil)
+	p.RenderOpts.Coloring = ColoringEscapeTime
+	escape := mustGenerate(t, p)
+
+	var exterior, bright int
+	for py := 0; py < 64; py++ {
+		for px := 0; px < 64; px++ {
+			s := f.PixelSamples(px, py)[0]
+			if !s.Escaped {
+				continue
+			}
+			exterior++
+			a, b := stalks.RGBAAt(px, py), escape.RGBAAt(px, py)
+			onStalk := s.trap < p.RenderOpts.Stalks.Width
+			if onStalk {
+				bright++
+				if int(a.R)+int(a.G)+int(a.B) <= int(b.R)+int(b.G)+int(b.B) && b != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+					t.Errorf("pixel (%d, %d) on a stalk is not brighter than escape time: %v vs %v", px, py, a, b)
+				}
+			} else if a != b {
+				t.Errorf("pixel (%d, %d) off the stalks = %v, want the escape-time color %v", px, py, a, b)
+			}
+		}
+	}
+	// 茎は細いので、明るくなるのは外部の一部だけ
+	if bright == 0 || bright*3 > exterior {
+		t.Errorf("%d of %d exterior pixels are on stalks, want a thin minority", bright, exterior)
+	}
+}
+
+func TestDistanceGlowFadesWithDistance(t *testing.T) {
+	p := testParameters(64, 64)
+	p.RenderOpts.SubPixelSamples = 1
+	p.RenderOpts.Coloring = ColoringDistanceGlow
+	g, f := mustCompute(t, p)
+	img := g.Colorize(f, nil)
+
+	type glow struct {
+		distance float64
+		green    uint8
+	}
+	var glows []glow
+	for py := 0; py < 64; py++ {
+		for px := 0; px < 64; px++ {
+			s := f.PixelSamples(px, py)[0]
+			if d, ok := g.boundaryDistance(s); ok && s.Escaped {
+				glows = append(glows, glow{d, img.RGBAAt(px, py).G})
+			}
+		}
+	}
+	slices.SortFunc(glows, func(a, b glow) int { return cmp.Compare(a.distance, b.distance) })
+
+	// 境界から離れるほど暗くなり、近くは明るく、遠くは背景の黒に近い
+	for i := 1; i < len(glows); i++ {
+		if glows[i].green > glows[i-1].green {
+			t.Fatalf("glow at distance %g (%d) is brighter than at %g (%d)",
+				glows[i].distance, glows[i].green, glows[i-1].distance, glows[i-1].green)
+		}
+	}
+	if near, far := glows[0], glows[len(glows)-1]; near.green < 128 || far.green > 16 {
+		t.Errorf("glow = %d at distance %g and %d at %g, want bright near the boundary and dark far away",
+			near.green, near.distance, far.green, far.distance)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"math/cmplx"
+	"slices"
+)
+
+// Component はマンデルブロ集合の双曲成分 (主カージオイドとそれに接するバルブ) を表す
+type Component struct {
+	// 成分の中心 (周期 Period の軌道が 0 に戻る点)
+	Center complex128
+	Period int
+	// 成分のおおよその半径。主カージオイドは 0.5、p/q バルブは sin(πp/q)/q² で近似する。
+	Radius float64
+}
+
+// VisibleComponents は主カージオイドと、それに直接接する周期 maxPeriod 以下のバルブのうち、
+// 中心と半径で決まる範囲がビューポートにかかるものを周期の順に返す。
+// バルブの中心は接点から外側に半径だけ離れた点を初期値に、ニュートン法で求める。
+// バルブに接するさらに小さなバルブや小さなコピーは含まない。
+func (g *Generator) VisibleComponents(maxPeriod int) []Component {
+	if maxPeriod < 1 {
+		return nil
+	}
+	all := []Component{{Center: 0, Period: 1, Radius: 0.5}}
+	for q := 2; q <= maxPeriod; q++ {
+		for p := 1; p < q; p++ {
+			if gcd(p, q) != 1 {
+				continue
+			}
+			theta := 2 * math.Pi * float64(p) / float64(q)
+			// 主カージオイド上の接点と、そこでの外向きの法線
+			root := cmplx.Exp(complex(0, theta))/2 - cmplx.Exp(complex(0, 2*theta))/4
+			tangent := complex(0, 1)*cmplx.Exp(complex(0, theta))/2 - complex(0, 1)*cmplx.Exp(complex(0, 2*theta))/2
+			normal := -complex(0, 1) * tangent / complex(cmplx.Abs(tangent), 0)
+
+			r := math.Sin(math.Pi*float64(p)/float64(q)) / float64(q*q)
+			center := nucleus(root+normal*complex(r, 0), q)
+			all = append(all, Component{Center: center, Period: q, Radius: r})
+		}
+	}
+
+	vp := g.params.ViewPort
+	var visible []Component
+	for _, c := range all {
+		x, y := real(c.Center), imag(c.Center)
+		if x+c.Radius >= vp.XMin && x-c.Radius <= vp.XMax && y+c.Radius >= vp.YMin && y-c.Radius <= vp.YMax {
+			visible = append(visible, c)
+		}
+	}
+	slices.SortStableFunc(visible, func(a, b Component) int {
+		return cmp.Compare(a.Period, b.Period)
+	})
+	return visible
+}
+
+// c の近くにある周期 period の成分の中心を、z_period(c) = 0 をニュートン法で解いて求める
+func nucleus(c complex128, period int) complex128 {
+	for range 64 {
+		var z, dz complex128
+		for range period {
+			dz = 2*z*dz + 1
+			z = z*z + c
+		}
+		if dz == 0 {
+			break
+		}
+		step := z / dz
+		c -= step
+		if cmplx.Abs(step) < 1e-15 {
+			break
+		}
+	}
+	return c
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/cmplx"
+	"testing"
+)
+
+func TestVisibleComponentsOfDefaultView(t *testing.T) {
+	g := mustGenerator(t, NewDefaultParameters())
+	components := g.VisibleComponents(3)
+
+	want := []Component{
+		{Center: 0, Period: 1},
+		{Center: -1, Period: 2},
+		{Center: complex(-0.1225611669, 0.7448617666), Period: 3},
+		{Center: complex(-0.1225611669, -0.7448617666), Period: 3},
+	}
+	for _, w := range want {
+		found := false
+		for _, c := range components {
+			if c.Period == w.Period && cmplx.Abs(c.Center-w.Center) < 1e-6 {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("period %d component at %v is missing from %v", w.Period, w.Center, components)
+		}
+	}
+	for i := 1; i < len(components); i++ {
+		if components[i].Period < components[i-1].Period {
+			t.Errorf("components are not sorted by period: %v", components)
+		}
+	}
+}
+
+func TestVisibleComponentsOutsideView(t *testing.T) {
+	p := testParameters(32, 32)
+	p.ViewPort.XMin, p.ViewPort.XMax = 1, 2
+	p.ViewPort.YMin, p.ViewPort.YMax = 1, 2
+	if c := mustGenerator(t, p).VisibleComponents(5); len(c) != 0 {
+		t.Errorf("VisibleComponents far from the set = %v, want none", c)
+	}
+	if c := mustGenerator(t, NewDefaultParameters()).VisibleComponents(0); c != nil {
+		t.Errorf("VisibleComponents(0) = %v, want nil", c)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"os"
+)
+
+// NormalizeParameters は 0 のままでは不正になるか意味をなさない値を NewDefaultParameters の値で埋め、
+// 検証した結果を返す。0 に意味がある値 (PixelJitter や PeriodicityEpsilon など) はそのまま残す。
+// Contrast が 0 の場合は MaxIterations に見合った値 (DefaultContrast) にする。
+func NormalizeParameters(p Parameters) (Parameters, error) {
+	d := NewDefaultParameters()
+
+	vp := &p.ViewPort
+	if vp.XMin == 0 && vp.YMin == 0 && vp.XMax == 0 && vp.YMax == 0 {
+		vp.XMin, vp.YMin, vp.XMax, vp.YMax = d.ViewPort.XMin, d.ViewPort.YMin, d.ViewPort.XMax, d.ViewPort.YMax
+	}
+	if p.Size.Width == 0 {
+		p.Size.Width = d.Size.Width
+	}
+	if p.Size.Height == 0 {
+		p.Size.Height = d.Size.Height
+	}
+
+	ro := &p.RenderOpts
+	if ro.SubPixelSamples == 0 {
+		ro.SubPixelSamples = d.RenderOpts.SubPixelSamples
+	}
+	if ro.MaxIterations == 0 {
+		ro.MaxIterations = d.RenderOpts.MaxIterations
+	}
+	if ro.Contrast == 0 {
+		ro.Contrast = DefaultContrast(ro.MaxIterations)
+	}
+	if ro.DecompositionColors == nil {
+		ro.DecompositionColors = d.RenderOpts.DecompositionColors
+	}
+	if ro.Stalks.RealWeight == 0 && ro.Stalks.ImagWeight == 0 {
+		ro.Stalks.RealWeight, ro.Stalks.ImagWeight = d.RenderOpts.Stalks.RealWeight, d.RenderOpts.Stalks.ImagWeight
+	}
+	if ro.Stalks.Width == 0 {
+		ro.Stalks.Width = d.RenderOpts.Stalks.Width
+	}
+	if ro.Glow.Width == 0 {
+		ro.Glow.Width = d.RenderOpts.Glow.Width
+	}
+	if ro.Glow.Color == (color.RGBA{}) {
+		ro.Glow.Color = d.RenderOpts.Glow.Color
+	}
+
+	pp := &p.PostProcess
+	if pp.MLAA.Threshold == 0 {
+		pp.MLAA.Threshold = d.PostProcess.MLAA.Threshold
+	}
+	if pp.Bloom.Intensity == 0 {
+		pp.Bloom.Intensity = d.PostProcess.Bloom.Intensity
+	}
+	if pp.Bloom.Radius == 0 {
+		pp.Bloom.Radius = d.PostProcess.Bloom.Radius
+	}
+	if pp.Crop.Feather == 0 {
+		pp.Crop.Feather = d.PostProcess.Crop.Feather
+	}
+
+	if err := validateParameters(p); err != nil {
+		return Parameters{}, err
+	}
+	return p, nil
+}
+
+// LoadParameters は JSON の設定ファイルを読み込む。書かれていない項目は NewDefaultParameters の値になり、
+// 0 と書かれて不正になる項目も NormalizeParameters で既定値に置き換える。
+// 関数やパレットは JSON に含まれないので、必要なら読み込んだ後に設定する。
+func LoadParameters(filename string) (Parameters, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return Parameters{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	p := NewDefaultParameters()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return Parameters{}, fmt.Errorf("failed to decode parameters: %w", err)
+	}
+	return NormalizeParameters(p)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// JSON を一時ファイルに書いて LoadParameters で読み込む
+func loadJSON(t *testing.T, data string) (Parameters, error) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "params.json")
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadParameters(name)
+}
+
+func TestLoadParametersInheritsDefaults(t *testing.T) {
+	p, err := loadJSON(t, `{"ViewPort": {"XMin": -1, "XMax": 0, "YMin": -0.5, "YMax": 0.5}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDefaultParameters()
+	if vp := p.ViewPort; vp.XMin != -1 || vp.XMax != 0 || vp.YMin != -0.5 || vp.YMax != 0.5 {
+		t.Errorf("ViewPort = %+v, want the one in the file", vp)
+	}
+	if p.Size != d.Size {
+		t.Errorf("Size = %+v, want the default %+v", p.Size, d.Size)
+	}
+	if !reflect.DeepEqual(p.RenderOpts, d.RenderOpts) {
+		t.Errorf("RenderOpts = %+v, want the defaults %+v", p.RenderOpts, d.RenderOpts)
+	}
+}
+
+func TestLoadParametersReplacesZeros(t *testing.T) {
+	p, err := loadJSON(t, `{"Size": {"Width": 0, "Height": 120}, "RenderOpts": {"MaxIterations": 0, "PixelJitter": 0}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDefaultParameters()
+	if p.Size.Width != d.Size.Width || p.Size.Height != 120 {
+		t.Errorf("Size = %+v, want width %d and height 120", p.Size, d.Size.Width)
+	}
+	if p.RenderOpts.MaxIterations != d.RenderOpts.MaxIterations {
+		t.Errorf("MaxIterations = %d, want the default %d", p.RenderOpts.MaxIterations, d.RenderOpts.MaxIterations)
+	}
+	// 0 に意味がある値はそのまま残る
+	if p.RenderOpts.PixelJitter != 0 {
+		t.Errorf("PixelJitter = %g, want 0", p.RenderOpts.PixelJitter)
+	}
+}
+
+func TestNormalizeParametersFillsZeroValue(t *testing.T) {
+	var p Parameters
+	p.ViewPort.XMin, p.ViewPort.XMax, p.ViewPort.YMin, p.ViewPort.YMax = -1, 0, -0.5, 0.5
+	got, err := NormalizeParameters(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDefaultParameters()
+	if got.Size != d.Size || got.RenderOpts.SubPixelSamples != d.RenderOpts.SubPixelSamples ||
+		got.RenderOpts.Contrast != DefaultContrast(d.RenderOpts.MaxIterations) {
+		t.Errorf("NormalizeParameters(zero value) = %+v, want default size and render options", got)
+	}
+}
+
+func TestLoadParametersRejectsInvalid(t *testing.T) {
+	if _, err := loadJSON(t, `{"Size": {"Width": -4}}`); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("negative width: err = %v, want ErrInvalidParameters", err)
+	}
+	if _, err := loadJSON(t, `{"Unknown": 1}`); err == nil {
+		t.Error("unknown field: err = nil")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 等値線が横切る格子の辺。vertical が false なら (i, j)-(i+1, j) の辺、
+// true なら (i, j)-(i, j+1) の辺を表す。
+type gridEdge struct {
+	i, j     int
+	vertical bool
+}
+
+// WriteSVGContours は Field の内部・外部の境界をマーチングスクエアで追跡し、
+// 輪郭線を path 要素とする SVG を w に書き出す。座標の単位はピクセル。
+func WriteSVGContours(w io.Writer, f *Field) error {
+	paths := traceContours(f)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		f.Width, f.Height, f.Width, f.Height)
+	for _, p := range paths {
+		fmt.Fprint(bw, `<path fill="none" stroke="black" stroke-width="0.5" d="`)
+		for i, pt := range p.points {
+			cmd := "L"
+			if i == 0 {
+				cmd = "M"
+			}
+			fmt.Fprintf(bw, "%s%.3f,%.3f", cmd, pt.x, pt.y)
+		}
+		if p.closed {
+			fmt.Fprint(bw, "Z")
+		}
+		fmt.Fprint(bw, "\"/>\n")
+	}
+	fmt.Fprint(bw, "</svg>\n")
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write svg: %w", err)
+	}
+	return nil
+}
+
+// SaveSVGContours は WriteSVGContours の結果をファイルに保存する
+func SaveSVGContours(f *Field, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	return WriteSVGContours(file, f)
+}
+
+// contourPath は輪郭線を構成する頂点の列
+type contourPath struct {
+	points []point
+	closed bool
+}
+
+// マーチングスクエアの各ケースで結ぶ辺の組。辺の番号は 0: 上, 1: 右, 2: 下, 3: 左。
+// 鞍点になる 5 と 10 はセル中央が外部の場合の結び方を持つ。
+var marchingSegments = [16][][2]int{
+	{}, {{3, 2}}, {{2, 1}}, {{3, 1}},
+	{{0, 1}}, {{0, 1}, {3, 2}}, {{0, 2}}, {{3, 0}},
+	{{0, 3}}, {{0, 2}}, {{3, 0}, {2, 1}}, {{0, 1}},
+	{{3, 1}}, {{2, 1}}, {{3, 2}}, {},
+}
+
+// traceContours は内部サンプルの割合が 0.5 になる等値線を追跡する
+func traceContours(f *Field) []contourPath {
+	// 画像の外周を外部 (0) で囲み、輪郭が必ず閉じるようにする
+	gw, gh := f.Width+2, f.Height+2
+	values := make([]float64, gw*gh)
+	for py := 0; py < f.Height; py++ {
+		for px := 0; px < f.Width; px++ {
+			samples := f.PixelSamples(px, py)
+			var inside int
+			for _, s := range samples {
+				if !s.Escaped {
+					inside++
+				}
+			}
+			values[(py+1)*gw+px+1] = float64(inside) / float64(len(samples))
+		}
+	}
+	value := func(i, j int) float64 { return values[j*gw+i] }
+
+	// 格子の辺上で等値線が通る位置 (ピクセル座標)
+	position := func(e gridEdge) point {
+		a := value(e.i, e.j)
+		var b float64
+		if e.vertical {
+			b = value(e.i, e.j+1)
+		} else {
+			b = value(e.i+1, e.j)
+		}
+		t := (0.5 - a) / (b - a)
+		x, y := float64(e.i)-0.5, float64(e.j)-0.5
+		if e.vertical {
+			y += t
+		} else {
+			x += t
+		}
+		return point{x, y}
+	}
+
+	links := make(map[gridEdge][]gridEdge)
+	for j := 0; j+1 < gh; j++ {
+		for i := 0; i+1 < gw; i++ {
+			corners := [4]float64{value(i, j), value(i+1, j), value(i+1, j+1), value(i, j+1)}
+			c := 0
+			for k, v := range corners {
+				if v >= 0.5 {
+					c |= 8 >> k
+				}
+			}
+			edges := [4]gridEdge{
+				{i, j, false},
+				{i + 1, j, true},
+				{i, j + 1, false},
+				{i, j, true},
+			}
+			segments := marchingSegments[c]
+			if (c == 5 || c == 10) && (corners[0]+corners[1]+corners[2]+corners[3])/4 >= 0.5 {
+				// 中央が内部なら、外部の角を切り離す向きに結び直す
+				segments = marchingSegments[15-c]
+			}
+			for _, s := range segments {
+				a, b := edges[s[0]], edges[s[1]]
+				links[a] = append(links[a], b)
+				links[b] = append(links[b], a)
+			}
+		}
+	}
+
+	// 辺のつながりをたどって頂点列にまとめる
+	visited := make(map[gridEdge]bool)
+	var paths []contourPath
+	walk := func(start gridEdge) contourPath {
+		p := contourPath{}
+		cur := start
+		for {
+			visited[cur] = true
+			p.points = append(p.points, position(cur))
+			next, ok := gridEdge{}, false
+			for _, n := range links[cur] {
+				if !visited[n] {
+					next, ok = n, true
+					break
+				}
+			}
+			if !ok {
+				for _, n := range links[cur] {
+					if n == start && len(p.points) > 2 {
+						p.closed = true
+					}
+				}
+				return p
+			}
+			cur = next
+		}
+	}
+	// 端点 (つながりが1つだけの辺) から始まる開いた線を先に処理する
+	for e, l := range links {
+		if len(l) == 1 && !visited[e] {
+			paths = append(paths, walk(e))
+		}
+	}
+	for e := range links {
+		if !visited[e] {
+			paths = append(paths, walk(e))
+		}
+	}
+	return paths
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// 中心 (16, 16)、半径 r の円の内側だけが内部の Field
+func discField(r float64) *Field {
+	f := &Field{Width: 32, Height: 32, SamplesPerPixel: 1, Samples: make([]Sample, 32*32)}
+	for py := 0; py < 32; py++ {
+		for px := 0; px < 32; px++ {
+			inside := math.Hypot(float64(px)+0.5-16, float64(py)+0.5-16) < r
+			f.PixelSamples(px, py)[0] = Sample{Escaped: !inside}
+		}
+	}
+	return f
+}
+
+func TestSVGContoursOfDisc(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSVGContours(&buf, discField(8)); err != nil {
+		t.Fatal(err)
+	}
+	svg := buf.String()
+	if !strings.HasPrefix(svg, "<svg") || !strings.HasSuffix(svg, "</svg>\n") {
+		t.Errorf("output is not an svg document:\n%s", svg)
+	}
+	if n := strings.Count(svg, "<path"); n != 1 {
+		t.Fatalf("svg has %d paths, want 1 for a disc", n)
+	}
+
+	paths := traceContours(discField(8))
+	if !paths[0].closed {
+		t.Error("the disc contour is not closed")
+	}
+	// 半径 8 の円周は約 50 ピクセルなので、頂点もおよそその数になる
+	if n := len(paths[0].points); n < 25 || n > 100 {
+		t.Errorf("disc contour has %d vertices, want about 50", n)
+	}
+	for _, p := range paths[0].points {
+		if d := math.Hypot(p.x-16, p.y-16); math.Abs(d-8) > 0.75 {
+			t.Errorf("vertex %v is %g from the center, want about 8", p, d)
+		}
+	}
+}
+
+func TestSVGContoursOfEmptyField(t *testing.T) {
+	if paths := traceContours(discField(0)); len(paths) != 0 {
+		t.Errorf("field without interior has %d contours, want 0", len(paths))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/cmplx"
+	"slices"
+)
+
+// DetectAnomalies は反復計算の不具合が疑われるピクセルを探す。
+// 結果はあくまで目安で、次のいずれかに当てはまるピクセルを返す。
+//   - サンプルの値が NaN や無限大になっている
+//   - 脱出していないのに値が 2 を超えている (RenderOpts.Bailout を変えた場合は誤検出することがある)
+//   - 周囲がすべて外部なのに、そのピクセルだけが内部として黒く描かれている
+func DetectAnomalies(img image.Image, f *Field) []image.Point {
+	interior := func(px, py int) bool {
+		for _, s := range f.PixelSamples(px, py) {
+			if s.Escaped {
+				return false
+			}
+		}
+		return true
+	}
+	exterior := func(px, py int) bool {
+		if px < 0 || py < 0 || px >= f.Width || py >= f.Height {
+			return true
+		}
+		for _, s := range f.PixelSamples(px, py) {
+			if !s.Escaped {
+				return false
+			}
+		}
+		return true
+	}
+
+	b := img.Bounds()
+	var points []image.Point
+	for py := 0; py < f.Height; py++ {
+		for px := 0; px < f.Width; px++ {
+			if suspiciousSamples(f.PixelSamples(px, py)) {
+				points = append(points, image.Pt(px, py))
+				continue
+			}
+
+			r, g, bl, _ := img.At(b.Min.X+px, b.Min.Y+py).RGBA()
+			black := r == 0 && g == 0 && bl == 0
+			if black && interior(px, py) &&
+				exterior(px-1, py) && exterior(px+1, py) && exterior(px, py-1) && exterior(px, py+1) {
+				points = append(points, image.Pt(px, py))
+			}
+		}
+	}
+	return points
+}
+
+// 値が有限でないか、脱出判定と矛盾するサンプルが含まれているか調べる
+func suspiciousSamples(samples []Sample) bool {
+	for _, s := range samples {
+		if cmplx.IsNaN(s.Z) || cmplx.IsInf(s.Z) {
+			return true
+		}
+		if !s.Escaped && cmplx.Abs(s.Z) > 2 {
+			return true
+		}
+	}
+	return false
+}
+
+// CompareImages は2つの画像をチャンネルごとに 8bit で比較し、差の最大値と
+// それが tolerance 以内かどうかを返す。大きさが異なる場合は 255, false を返す。
+func CompareImages(a, b image.Image, tolerance uint8) (maxDiff uint8, ok bool) {
+	ra, rb := a.Bounds(), b.Bounds()
+	if ra.Size() != rb.Size() {
+		return 255, false
+	}
+
+	for y := 0; y < ra.Dy(); y++ {
+		for x := 0; x < ra.Dx(); x++ {
+			r1, g1, b1, a1 := a.At(ra.Min.X+x, ra.Min.Y+y).RGBA()
+			r2, g2, b2, a2 := b.At(rb.Min.X+x, rb.Min.Y+y).RGBA()
+			for _, c := range [][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}, {a1, a2}} {
+				d := absDiff(uint8(c[0]>>8), uint8(c[1]>>8))
+				maxDiff = max(maxDiff, d)
+			}
+		}
+	}
+	return maxDiff, maxDiff <= tolerance
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// IterationHistogram は脱出したサンプルの反復回数 0..maxN を bins 個の区間に分けて数える
+func (f *Field) IterationHistogram(bins, maxN int) []int {
+	hist := make([]int, bins)
+	if bins <= 0 || maxN <= 0 {
+		return hist
+	}
+	for _, s := range f.Samples {
+		if s.Escaped {
+			hist[min(s.N*bins/maxN, bins-1)]++
+		}
+	}
+	return hist
+}
+
+// DiagnosticImage は f を彩色した画像の下に、高さ histHeight の反復回数のヒストグラムを
+// 棒グラフとして描き足した画像を返す。露出の具合を目で確かめるのに使う。
+func (g *Generator) DiagnosticImage(f *Field, histHeight int) *image.RGBA {
+	render := g.Colorize(f, nil)
+	histHeight = max(histHeight, 1)
+
+	img := image.NewRGBA(image.Rect(0, 0, f.Width, f.Height+histHeight))
+	draw.Draw(img, render.Bounds(), render, image.Point{}, draw.Src)
+
+	chart := image.Rect(0, f.Height, f.Width, f.Height+histHeight)
+	draw.Draw(img, chart, image.NewUniform(color.RGBA{R: 32, G: 32, B: 32, A: 255}), image.Point{}, draw.Src)
+
+	hist := f.IterationHistogram(f.Width, g.params.RenderOpts.MaxIterations)
+	peak := slices.Max(hist)
+	if peak == 0 {
+		return img
+	}
+	for x, count := range hist {
+		h := count * histHeight / peak
+		bar := image.Rect(x, chart.Max.Y-h, x+1, chart.Max.Y)
+		draw.Draw(img, bar, image.White, image.Point{}, draw.Src)
+	}
+	return img
+}
+
+// SaveDiagnosticImage は DiagnosticImage の結果を PNG で保存する
+func (g *Generator) SaveDiagnosticImage(f *Field, histHeight int, filename string) error {
+	return SaveImage(g.DiagnosticImage(f, histHeight), filename)
+}
+
+// EdgeMap は各ピクセルの平均反復回数の勾配の大きさを、最大値が白になるように正規化した
+// グレースケール画像を返す。細部がどこに集まっているかを見てサンプリングを調整するのに使う。
+func EdgeMap(f *Field) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, f.Width, f.Height))
+	at := func(px, py int) float64 {
+		return f.PixelIterations(max(0, min(px, f.Width-1)), max(0, min(py, f.Height-1)))
+	}
+
+	// 中心差分で勾配を求める。画像の端は端のピクセルを延長して扱う。
+	grad := make([]float64, f.Width*f.Height)
+	var peak float64
+	for py := 0; py < f.Height; py++ {
+		for px := 0; px < f.Width; px++ {
+			dx := (at(px+1, py) - at(px-1, py)) / 2
+			dy := (at(px, py+1) - at(px, py-1)) / 2
+			v := math.Hypot(dx, dy)
+			grad[py*f.Width+px] = v
+			peak = max(peak, v)
+		}
+	}
+	if peak == 0 {
+		return img
+	}
+	for i, v := range grad {
+		img.Pix[i] = toUint8(v / peak)
+	}
+	return img
+}
+
+// BoxCountingDimension は境界のピクセルを 1, 2, 4, ... ピクセル四方の箱で覆い、
+// 箱の数の対数と箱の大きさの対数の傾きから境界のボックス次元を見積もる。
+// 境界のピクセルは、上下左右の隣と内部・外部の判定が異なるピクセルとする。
+// 画像が小さすぎて2段階以上の大きさを取れない場合や、境界がない場合は 0 を返す。
+func (f *Field) BoxCountingDimension() float64 {
+	inside := make([]bool, f.Width*f.Height)
+	for py := 0; py < f.Height; py++ {
+		for px := 0; px < f.Width; px++ {
+			var n int
+			samples := f.PixelSamples(px, py)
+			for _, s := range samples {
+				if !s.Escaped {
+					n++
+				}
+			}
+			inside[py*f.Width+px] = 2*n > len(samples)
+		}
+	}
+	boundary := func(px, py int) bool {
+		v := inside[py*f.Width+px]
+		return (px > 0 && inside[py*f.Width+px-1] != v) ||
+			(px+1 < f.Width && inside[py*f.Width+px+1] != v) ||
+			(py > 0 && inside[(py-1)*f.Width+px] != v) ||
+			(py+1 < f.Height && inside[(py+1)*f.Width+px] != v)
+	}
+
+	// 箱の大きさ s ごとに、境界のピクセルを含む箱を数える
+	var xs, ys []float64
+	for size := 1; size <= min(f.Width, f.Height)/4; size *= 2 {
+		cols := (f.Width + size - 1) / size
+		boxes := make(map[int]bool)
+		for py := 0; py < f.Height; py++ {
+			for px := 0; px < f.Width; px++ {
+				if boundary(px, py) {
+					boxes[(py/size)*cols+px/size] = true
+				}
+			}
+		}
+		if len(boxes) == 0 {
+			return 0
+		}
+		xs = append(xs, -math.Log(float64(size)))
+		ys = append(ys, math.Log(float64(len(boxes))))
+	}
+	if len(xs) < 2 {
+		return 0
+	}
+
+	// 最小二乗法で傾きを求める
+	var sx, sy, sxx, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+	}
+	n := float64(len(xs))
+	return (n*sxy - sx*sy) / (n*sxx - sx*sx)
+}
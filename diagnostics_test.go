@@ -0,0 +1,149 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/cmplx"
+	"testing"
+)
+
+func TestDetectAnomaliesFlagsNaNRegion(t *testing.T) {
+	g, f := mustCompute(t, testParameters(32, 32))
+	if points := DetectAnomalies(g.Colorize(f, nil), f); len(points) != 0 {
+		t.Errorf("clean render has anomalies at %v", points)
+	}
+
+	// 外部の領域の一部を、NaN になって内部と判定されたように壊す
+	bad := image.Rect(2, 2, 5, 4)
+	for py := bad.Min.Y; py < bad.Max.Y; py++ {
+		for px := bad.Min.X; px < bad.Max.X; px++ {
+			for i := range f.PixelSamples(px, py) {
+				f.PixelSamples(px, py)[i] = Sample{Z: cmplx.NaN(), N: g.params.RenderOpts.MaxIterations}
+			}
+		}
+	}
+	flagged := make(map[image.Point]bool)
+	for _, p := range DetectAnomalies(g.Colorize(f, nil), f) {
+		flagged[p] = true
+	}
+	for py := bad.Min.Y; py < bad.Max.Y; py++ {
+		for px := bad.Min.X; px < bad.Max.X; px++ {
+			if !flagged[image.Pt(px, py)] {
+				t.Errorf("corrupted pixel (%d, %d) is not flagged", px, py)
+			}
+		}
+	}
+	if len(flagged) != bad.Dx()*bad.Dy() {
+		t.Errorf("%d pixels flagged, want only the %d corrupted ones", len(flagged), bad.Dx()*bad.Dy())
+	}
+}
+
+func TestDetectAnomaliesFlagsIsolatedInteriorPixel(t *testing.T) {
+	g, f := mustCompute(t, testParameters(32, 32))
+	// 周囲が外部の1ピクセルだけを、値は有限のまま内部にする
+	for i := range f.PixelSamples(3, 3) {
+		f.PixelSamples(3, 3)[i] = Sample{Z: complex(0.1, 0), N: g.params.RenderOpts.MaxIterations}
+	}
+	points := DetectAnomalies(g.Colorize(f, nil), f)
+	if len(points) != 1 || points[0] != image.Pt(3, 3) {
+		t.Errorf("anomalies at %v, want only (3, 3)", points)
+	}
+}
+
+func TestCompareImages(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for i := range a.Pix {
+		a.Pix[i] = uint8(i * 7)
+	}
+	b := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	copy(b.Pix, a.Pix)
+
+	if diff, ok := CompareImages(a, b, 0); diff != 0 || !ok {
+		t.Errorf("identical images: diff %d, ok %v", diff, ok)
+	}
+	b.Pix[5]++
+	if diff, ok := CompareImages(a, b, 0); diff != 1 || ok {
+		t.Errorf("one channel off by one with tolerance 0: diff %d, ok %v", diff, ok)
+	}
+	if diff, ok := CompareImages(a, b, 1); diff != 1 || !ok {
+		t.Errorf("one channel off by one with tolerance 1: diff %d, ok %v", diff, ok)
+	}
+	// 位置が違っても大きさが同じなら比べられる
+	if _, ok := CompareImages(a, b.SubImage(b.Bounds()), 1); !ok {
+		t.Error("subimage with the same size did not compare equal")
+	}
+	if diff, ok := CompareImages(a, image.NewRGBA(image.Rect(0, 0, 3, 3)), 255); diff != 255 || ok {
+		t.Errorf("different sizes: diff %d, ok %v", diff, ok)
+	}
+}
+
+func TestDiagnosticImage(t *testing.T) {
+	g, f := mustCompute(t, testParameters(40, 30))
+	img := g.DiagnosticImage(f, 12)
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 30+12 {
+		t.Fatalf("diagnostic image is %v, want 40x42", b)
+	}
+
+	// 上は彩色した画像そのもの
+	render := g.Colorize(f, nil)
+	if _, ok := CompareImages(img.SubImage(image.Rect(0, 0, 40, 30)), render, 0); !ok {
+		t.Error("top of the diagnostic image differs from the render")
+	}
+	// 下のグラフには白い棒がある
+	var bars int
+	for y := 30; y < 42; y++ {
+		for x := 0; x < 40; x++ {
+			if img.RGBAAt(x, y) == (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+				bars++
+			}
+		}
+	}
+	if bars == 0 {
+		t.Error("histogram has no bars")
+	}
+}
+
+func TestEdgeMapHighlightsBoundary(t *testing.T) {
+	f := discField(8)
+	for i := range f.Samples {
+		if f.Samples[i].Escaped {
+			f.Samples[i].N = 5
+		} else {
+			f.Samples[i].N = 200
+		}
+	}
+	edges := EdgeMap(f)
+
+	// 円の縁は明るく、中心と外側の平らな領域は暗い
+	if v := edges.GrayAt(16, 8).Y; v < 128 {
+		t.Errorf("edge map on the boundary = %d, want bright", v)
+	}
+	for _, p := range []image.Point{{16, 16}, {1, 1}, {30, 16}} {
+		if v := edges.GrayAt(p.X, p.Y).Y; v != 0 {
+			t.Errorf("edge map at flat %v = %d, want 0", p, v)
+		}
+	}
+}
+
+func TestBoxCountingDimensionOfFullSet(t *testing.T) {
+	p := testParameters(128, 128)
+	p.ViewPort.XMin, p.ViewPort.XMax = -2.2, 0.8
+	p.ViewPort.YMin, p.ViewPort.YMax = -1.5, 1.5
+	p.RenderOpts.SubPixelSamples = 1
+	_, f := mustCompute(t, p)
+	if d := f.BoxCountingDimension(); d <= 1 || d >= 2 {
+		t.Errorf("BoxCountingDimension = %g, want between 1 and 2", d)
+	}
+}
+
+func TestBoxCountingDimensionOfDisc(t *testing.T) {
+	// 円の境界は滑らかな曲線なので、次元はほぼ 1 になる
+	if d := discField(12).BoxCountingDimension(); d < 0.8 || d > 1.2 {
+		t.Errorf("BoxCountingDimension of a disc = %g, want about 1", d)
+	}
+	// 境界がない
+	empty := &Field{Width: 32, Height: 32, SamplesPerPixel: 1, Samples: make([]Sample, 32*32)}
+	if d := empty.BoxCountingDimension(); d != 0 {
+		t.Errorf("BoxCountingDimension without a boundary = %g, want 0", d)
+	}
+}
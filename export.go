@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParameterFilename は p の主要な値 (中心・倍率・反復回数・サイズ) を含む、
+// ファイル名として安全で決定的な名前を返す。それ以外の値の違いは末尾のハッシュに反映する。
+// 関数やパレットの違いは区別しない。
+func ParameterFilename(p Parameters, ext string) string {
+	vp := p.ViewPort
+	cx, cy := (vp.XMin+vp.XMax)/2, (vp.YMin+vp.YMax)/2
+	zoom := 4 / (vp.XMax - vp.XMin)
+
+	name := fmt.Sprintf("mandelbrot_re%s_im%s_zoom%s_it%d_%dx%d_%08x",
+		formatFilenameFloat(cx), formatFilenameFloat(cy), formatFilenameFloat(zoom),
+		p.RenderOpts.MaxIterations, p.Size.Width, p.Size.Height, parameterHash(p))
+	return name + "." + strings.TrimPrefix(ext, ".")
+}
+
+// SaveImageNamed は ParameterFilename で決めた名前で dir に PNG を保存し、そのパスを返す
+func SaveImageNamed(img *image.RGBA, p Parameters, dir string) (string, error) {
+	filename := filepath.Join(dir, ParameterFilename(p, "png"))
+	if err := SaveImage(img, filename); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// ファイル名に使えない '+' を除いた最短の表現で浮動小数点数を書く
+func formatFilenameFloat(v float64) string {
+	return strings.ReplaceAll(strconv.FormatFloat(v, 'g', -1, 64), "+", "")
+}
+
+// 関数やインターフェースを除いたパラメータのハッシュ値
+func parameterHash(p Parameters) uint32 {
+	p.ViewPort.Warp = nil
+	p.RenderOpts.Palette = nil
+	p.RenderOpts.Bailout = nil
+	p.RenderOpts.Random = nil
+	p.RenderOpts.BlueNoise = nil
+	p.Logger = nil
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%+v", p)
+	return h.Sum32()
+}
+
+// RenderStats はレンダリング結果の統計で、JSON のサイドカーファイルに書き出す
+type RenderStats struct {
+	// 関数やパレットは書き出されない
+	Parameters Parameters
+	// サンプルの反復回数の最小・最大・平均
+	MinIterations int
+	MaxIterations int
+	AvgIterations float64
+	// 脱出しなかった (内部と判定した) サンプルの割合。反復回数の上限に達したものと、
+	// 周期性の検出で打ち切ったものの両方を含む。
+	InteriorFraction float64
+	DurationSeconds  float64
+}
+
+// Stats は f の反復回数の統計をまとめる
+func (g *Generator) Stats(f *Field, duration time.Duration) RenderStats {
+	st := RenderStats{Parameters: g.params, DurationSeconds: duration.Seconds()}
+	if len(f.Samples) == 0 {
+		return st
+	}
+
+	st.MinIterations = math.MaxInt
+	var sum, interior int
+	for _, s := range f.Samples {
+		st.MinIterations = min(st.MinIterations, s.N)
+		st.MaxIterations = max(st.MaxIterations, s.N)
+		sum += s.N
+		if !s.Escaped {
+			interior++
+		}
+	}
+	st.AvgIterations = float64(sum) / float64(len(f.Samples))
+	st.InteriorFraction = float64(interior) / float64(len(f.Samples))
+	return st
+}
+
+// SaveSidecar は画像ファイル imageFilename と同じ場所に、拡張子を .json に変えた名前で
+// レンダリングの統計を書き出す。書き出したパスを返す。
+func (g *Generator) SaveSidecar(imageFilename string, f *Field, duration time.Duration) (string, error) {
+	filename := strings.TrimSuffix(imageFilename, filepath.Ext(imageFilename)) + ".json"
+
+	data, err := json.MarshalIndent(g.Stats(f, duration), "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode stats: %w", err)
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	return filename, nil
+}
+
+// IterationLayer は各ピクセルの平均反復回数を四捨五入して 16bit のグレースケールで表した画像を返す。
+// 65535 を超える値は 65535 になる。
+func IterationLayer(f *Field) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, f.Width, f.Height))
+	for py := 0; py < f.Height; py++ {
+		for px := 0; px < f.Width; px++ {
+			n := math.Round(f.PixelIterations(px, py))
+			img.SetGray16(px, py, color.Gray16{Y: uint16(min(n, math.MaxUint16))})
+		}
+	}
+	return img
+}
+
+// SaveLayers は f を彩色した画像を imageFilename に、反復回数のレイヤー (IterationLayer) を
+// 拡張子の前に ".iter" を付けた名前の 16bit PNG に保存する。合成用に色と深さを揃えて書き出すのに使う。
+// レイヤーを書き出したパスを返す。
+func (g *Generator) SaveLayers(imageFilename string, f *Field) (string, error) {
+	if err := SaveImage(g.Colorize(f, nil), imageFilename); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(imageFilename)
+	filename := strings.TrimSuffix(imageFilename, ext) + ".iter" + ext
+	if err := savePNG(IterationLayer(f), filename, png.DefaultCompression); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
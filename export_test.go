@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustCompute(t testing.TB, p Parameters) (*Generator, *Field) {
+	t.Helper()
+	g := mustGenerator(t, p)
+	f, err := g.Compute(context.Background())
+	if err != nil {
+		t.Fatalf("Compute: %v", err)
+	}
+	return g, f
+}
+
+func TestSaveSidecar(t *testing.T) {
+	g, f := mustCompute(t, testParameters(32, 24))
+
+	path, err := g.SaveSidecar(filepath.Join(t.TempDir(), "render.png"), f, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("SaveSidecar: %v", err)
+	}
+	if filepath.Base(path) != "render.json" {
+		t.Errorf("sidecar path = %q, want render.json", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("sidecar is not valid JSON: %v", err)
+	}
+	for _, key := range []string{"Parameters", "MinIterations", "MaxIterations", "AvgIterations", "InteriorFraction", "DurationSeconds"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("sidecar is missing %s", key)
+		}
+	}
+
+	var st RenderStats
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Parameters.Size.Width != 32 || st.Parameters.Size.Height != 24 {
+		t.Errorf("sidecar size = %dx%d, want 32x24", st.Parameters.Size.Width, st.Parameters.Size.Height)
+	}
+	if !(st.MinIterations <= int(st.AvgIterations) && st.AvgIterations <= float64(st.MaxIterations)) {
+		t.Errorf("iterations min %d, avg %g, max %d are out of order", st.MinIterations, st.AvgIterations, st.MaxIterations)
+	}
+	if st.MaxIterations > g.params.RenderOpts.MaxIterations {
+		t.Errorf("MaxIterations = %d, above the limit %d", st.MaxIterations, g.params.RenderOpts.MaxIterations)
+	}
+	// 既定のビューポートには内部も外部もある
+	if st.InteriorFraction <= 0 || st.InteriorFraction >= 1 {
+		t.Errorf("InteriorFraction = %g, want between 0 and 1", st.InteriorFraction)
+	}
+	if st.DurationSeconds != 1.5 {
+		t.Errorf("DurationSeconds = %g, want 1.5", st.DurationSeconds)
+	}
+}
+
+func TestInteriorFractionIncludesPeriodicSamples(t *testing.T) {
+	p := testParameters(32, 24)
+	g, f := mustCompute(t, p)
+	p.RenderOpts.PeriodicityEpsilon = 0
+	_, exact := mustCompute(t, p)
+
+	// 周期検出で打ち切ったサンプルも、上限まで回したサンプルと同じく内部として数える
+	if got, want := g.Stats(f, 0).InteriorFraction, g.Stats(exact, 0).InteriorFraction; got != want {
+		t.Errorf("InteriorFraction with periodicity detection = %g, without = %g", got, want)
+	}
+}
+
+func TestParameterFilename(t *testing.T) {
+	a := testParameters(32, 24)
+	b := a
+	b.ViewPort.XMin, b.ViewPort.XMax = -1, 0.5
+	c := a
+	c.RenderOpts.Seed = 7
+
+	names := map[string]bool{}
+	for _, p := range []Parameters{a, b, c} {
+		name := ParameterFilename(p, ".png")
+		if name != ParameterFilename(p, "png") {
+			t.Errorf("ParameterFilename is not deterministic: %q", name)
+		}
+		if strings.ContainsAny(name, `/\:*?"<>| +`) || !strings.HasSuffix(name, ".png") {
+			t.Errorf("%q is not a safe png filename", name)
+		}
+		names[name] = true
+	}
+	if len(names) != 3 {
+		t.Errorf("different parameters share filenames: %v", names)
+	}
+
+	// 関数はファイル名に影響しない
+	a.ViewPort.Warp = func(z complex128) complex128 { return z }
+	if _, ok := names[ParameterFilename(a, "png")]; !ok {
+		t.Error("a Warp function changed the filename")
+	}
+}
+
+func TestSaveImageNamed(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []Parameters{testParameters(8, 8), testParameters(8, 4)} {
+		path, err := SaveImageNamed(image.NewRGBA(image.Rect(0, 0, 8, 8)), p, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(path) != dir || filepath.Base(path) != ParameterFilename(p, "png") {
+			t.Errorf("saved to %q, want %q in %q", path, ParameterFilename(p, "png"), dir)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSaveLayers(t *testing.T) {
+	g, f := mustCompute(t, testParameters(24, 16))
+	filename := filepath.Join(t.TempDir(), "render.png")
+	layer, err := g.SaveLayers(filename, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(layer) != "render.iter.png" {
+		t.Errorf("layer path = %q, want render.iter.png", layer)
+	}
+
+	decode := func(name string) image.Image {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		img, err := png.Decode(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	// 補助のレイヤーは各ピクセルの平均反復回数を 16bit で持つ
+	depth := decode(layer)
+	for py := 0; py < 16; py++ {
+		for px := 0; px < 24; px++ {
+			want := uint16(math.Round(f.PixelIterations(px, py)))
+			if got := color.Gray16Model.Convert(depth.At(px, py)).(color.Gray16).Y; got != want {
+				t.Fatalf("layer at (%d, %d) = %d, want %d", px, py, got, want)
+			}
+		}
+	}
+	if _, ok := CompareImages(decode(filename), g.Colorize(f, nil), 0); !ok {
+		t.Error("color layer differs from Colorize")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// Sample は1つのサンプリングポイントの反復結果を表す
+type Sample struct {
+	Z       complex128 // 最後に計算した値
+	N       int        // 脱出までの反復回数 (脱出しなかった場合は反復回数の上限。Focus を参照)
+	Escaped bool
+	// 最後に計算した導関数の大きさ |dz|。境界に近いほど大きくなる。
+	// RenderOpts.DistanceEstimation が有効な場合だけ記録される。
+	Derivative float64
+
+	// 反復を再開するための導関数の値
+	dz complex128
+	// ピックオーバーの茎の配色で使う、軌道と座標軸との重み付き距離の最小値
+	trap float64
+	// 反復を再開するための周期検出の状態
+	period periodicity
+	// 周期検出で内部と判定したかどうか。Z や dz は判定した時点の値で、それ以上は反復しない。
+	periodic bool
+}
+
+// Field は画像全体の反復結果を保持する。
+// 一度計算すれば、反復し直さずに異なるパレットで何度でも彩色できる。
+type Field struct {
+	Width, Height   int
+	SamplesPerPixel int
+	// (py*Width+px)*SamplesPerPixel + i 番目に各ピクセルのサンプルが並ぶ
+	Samples []Sample
+
+	// 計算したときの反復の設定。ComputeFrom で再開できるかどうかの判定に使う。
+	mode iterationMode
+}
+
+// iterationMode はサンプルに記録される途中の状態を左右する設定をまとめる。
+// 異なる設定で計算したサンプルから反復を再開すると、導関数や茎の距離が正しく続かない。
+type iterationMode struct {
+	derivative bool
+	// ピックオーバーの茎の距離を追跡した場合の重み。追跡しない場合はどちらも 0。
+	stalkWeights       [2]float64
+	periodicityEpsilon float64
+}
+
+// 現在のパラメータでの反復の設定を返す
+func (g *Generator) iterationMode() iterationMode {
+	m := iterationMode{derivative: g.tracksDerivative(), periodicityEpsilon: g.params.RenderOpts.PeriodicityEpsilon}
+	if g.params.RenderOpts.Coloring == ColoringPickoverStalks {
+		m.stalkWeights = [2]float64{g.params.RenderOpts.Stalks.RealWeight, g.params.RenderOpts.Stalks.ImagWeight}
+	}
+	return m
+}
+
+// PixelSamples はピクセル (px, py) のサンプルを返す
+func (f *Field) PixelSamples(px, py int) []Sample {
+	i := (py*f.Width + px) * f.SamplesPerPixel
+	return f.Samples[i : i+f.SamplesPerPixel]
+}
+
+// Compute は彩色を行わずに反復計算だけを行う
+func (g *Generator) Compute(ctx context.Context) (*Field, error) {
+	return g.compute(ctx, nil)
+}
+
+// ComputeFrom は以前に計算した prev の状態から反復を再開する。
+// prev は同じビューポート・サイズ・サンプリングで、より少ない MaxIterations で計算したものでなければならない。
+// 脱出済みのサンプルは再計算せず、残りのサンプルだけを新しい MaxIterations まで反復する。
+// 導関数の追跡 (DistanceEstimation など)、ピックオーバーの茎、PeriodicityEpsilon の設定が
+// prev を計算したときと異なる場合はエラーを返す。
+func (g *Generator) ComputeFrom(ctx context.Context, prev *Field) (*Field, error) {
+	if prev.Width != g.params.Size.Width || prev.Height != g.params.Size.Height ||
+		prev.SamplesPerPixel != g.samplesPerPixel() {
+		return nil, fmt.Errorf("%w: field does not match image size or sampling", ErrInvalidParameters)
+	}
+	if prev.mode != g.iterationMode() {
+		return nil, fmt.Errorf("%w: field was computed with different iteration settings", ErrInvalidParameters)
+	}
+	return g.compute(ctx, prev)
+}
+
+func (g *Generator) compute(ctx context.Context, prev *Field) (f *Field, err error) {
+	done, interior := g.logRender("field")
+	defer func() { done(err) }()
+
+	samplingWidth, samplingHeight := g.samplingStep()
+	perPixel := g.samplesPerPixel()
+
+	f = &Field{
+		Width:           g.params.Size.Width,
+		Height:          g.params.Size.Height,
+		SamplesPerPixel: perPixel,
+		Samples:         make([]Sample, g.params.Size.Width*g.params.Size.Height*perPixel),
+		mode:            g.iterationMode(),
+	}
+
+	err = g.forEachRow(func(py int) error {
+		cancel := g.newCancelChecker(ctx)
+		for px := 0; px < f.Width; px++ {
+			if err := cancel.check(); err != nil {
+				return err
+			}
+			dst := f.PixelSamples(px, py)
+			for i, p := range g.samplePoints(px, py, g.params.RenderOpts.SubPixelSamples, samplingWidth, samplingHeight) {
+				var start Sample
+				if prev != nil {
+					start = prev.PixelSamples(px, py)[i]
+				}
+				dst[i] = g.resume(complex(p.x, p.y), start)
+				interior.add(dst[i])
+			}
+		}
+		return cancel.done()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error processing row: %w", err)
+	}
+	return f, nil
+}
+
+// Colorize は計算済みの Field を palette で彩色する。
+// palette が nil の場合は RenderOpts.Palette を、それも nil なら組み込みの配色を使う。
+func (g *Generator) Colorize(f *Field, palette Palette) *image.RGBA {
+	if palette == nil {
+		palette = g.params.RenderOpts.Palette
+	}
+	c := colorizer{palette: palette, maxN: g.params.RenderOpts.MaxIterations}
+	if g.params.RenderOpts.CycleCount > 0 {
+		c.minN, c.maxN = f.escapeRange()
+	}
+	img := newFloatImage(f.Width, f.Height)
+
+	// 彩色は失敗しない
+	_ = g.forEachRow(func(py int) error {
+		colors := make([]fcolor, f.SamplesPerPixel)
+		for px := 0; px < f.Width; px++ {
+			for i, s := range f.PixelSamples(px, py) {
+				colors[i] = g.sampleColor(s, c).toLinear()
+			}
+			img.set(px, py, averageColors(colors, g.params.RenderOpts.PremultipliedAverage))
+		}
+		return nil
+	})
+
+	g.postProcess(img)
+	return img.toRGBA(g.encoder())
+}
+
+// 脱出したサンプルの反復回数の最小値と最大値を返す
+func (f *Field) escapeRange() (minN, maxN int) {
+	minN, maxN = math.MaxInt, 0
+	for _, s := range f.Samples {
+		if s.Escaped {
+			minN, maxN = min(minN, s.N), max(maxN, s.N)
+		}
+	}
+	if minN > maxN {
+		return 0, 0
+	}
+	return minN, maxN
+}
+
+// ColorizeVariants は1つの Field を複数のパレットで並列に彩色する。
+// 戻り値は palettes と同じ順序で並ぶ。
+func (g *Generator) ColorizeVariants(f *Field, palettes []Palette) []*image.RGBA {
+	images := make([]*image.RGBA, len(palettes))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(g.workers(), len(palettes)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				images[i] = g.Colorize(f, palettes[i])
+			}
+		}()
+	}
+
+	for i := range palettes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return images
+}
+
+// PixelIterations はピクセル (px, py) のサンプルの反復回数の平均を返す
+func (f *Field) PixelIterations(px, py int) float64 {
+	var sum int
+	samples := f.PixelSamples(px, py)
+	for _, s := range samples {
+		sum += s.N
+	}
+	return float64(sum) / float64(len(samples))
+}
+
+// SelectComponent は start から上下左右につながり、反復回数が start との差 tolerance 以内の
+// ピクセルを塗りつぶしで選び、選ばれたピクセルを不透明にしたマスクを返す。
+func SelectComponent(f *Field, start image.Point, tolerance int) *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, f.Width, f.Height))
+	if !start.In(mask.Bounds()) {
+		return mask
+	}
+
+	base := f.PixelIterations(start.X, start.Y)
+	stack := []image.Point{start}
+	mask.SetAlpha(start.X, start.Y, color.Alpha{A: 255})
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, d := range []image.Point{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+			q := p.Add(d)
+			if !q.In(mask.Bounds()) || mask.AlphaAt(q.X, q.Y).A != 0 {
+				continue
+			}
+			if math.Abs(f.PixelIterations(q.X, q.Y)-base) > float64(tolerance) {
+				continue
+			}
+			mask.SetAlpha(q.X, q.Y, color.Alpha{A: 255})
+			stack = append(stack, q)
+		}
+	}
+	return mask
+}
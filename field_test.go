@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"math"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestColorizeMatchesGenerate(t *testing.T) {
+	p := testParameters(32, 24)
+	g, f := mustCompute(t, p)
+	want := mustGenerate(t, p)
+	if got := g.Colorize(f, nil); !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("Colorize of a computed field differs from Generate")
+	}
+}
+
+func TestColorizeVariants(t *testing.T) {
+	g, f := mustCompute(t, testParameters(32, 24))
+	palettes := []Palette{
+		CyclicGradient{{R: 255, A: 255}, {A: 255}},
+		CyclicGradient{{G: 255, A: 255}, {A: 255}},
+		CyclicGradient{{B: 255, A: 255}, {A: 255}},
+		CyclicGradient{{R: 255, G: 255, B: 255, A: 255}, {R: 64, A: 255}},
+	}
+
+	images := g.ColorizeVariants(f, palettes)
+	if len(images) != len(palettes) {
+		t.Fatalf("got %d images, want %d", len(images), len(palettes))
+	}
+	for i := range images {
+		if want := g.Colorize(f, palettes[i]); !bytes.Equal(images[i].Pix, want.Pix) {
+			t.Errorf("variant %d differs from colorizing with its palette", i)
+		}
+		for j := range i {
+			if bytes.Equal(images[i].Pix, images[j].Pix) {
+				t.Errorf("variants %d and %d are identical", j, i)
+			}
+		}
+	}
+}
+
+func TestFieldDerivativeNearBoundary(t *testing.T) {
+	p := testParameters(64, 64)
+	p.RenderOpts.DistanceEstimation = true
+	g, f := mustCompute(t, p)
+
+	// 境界に近い外部のピクセルほど |dz| が大きい
+	var near, far float64
+	for py := 0; py < f.Height; py++ {
+		for px := 0; px < f.Width; px++ {
+			for _, s := range f.PixelSamples(px, py) {
+				if s.Escaped {
+					near = max(near, s.Derivative)
+				}
+			}
+		}
+	}
+	for _, s := range f.PixelSamples(63, 0) {
+		far = max(far, s.Derivative)
+	}
+	if far <= 0 || near < 1000*far {
+		t.Errorf("largest |dz| near the boundary = %g, in the far corner = %g", near, far)
+	}
+	if s := g.iterate(complex(-0.75, 0.05)); !s.Escaped || s.Derivative < 1e3 {
+		t.Errorf("sample just outside the neck has |dz| = %g, want it large", s.Derivative)
+	}
+
+	p.RenderOpts.DistanceEstimation = false
+	_, plain := mustCompute(t, p)
+	for _, s := range plain.Samples {
+		if s.Derivative != 0 {
+			t.Fatal("Derivative is recorded without DistanceEstimation")
+		}
+	}
+}
+
+func TestDynamicBailoutChangesOnlyExterior(t *testing.T) {
+	p := testParameters(48, 48)
+	_, constant := mustCompute(t, p)
+	p.RenderOpts.Bailout = func(n int) float64 { return 2 + float64(n%7) }
+	g, dynamic := mustCompute(t, p)
+
+	var changed int
+	for i, s := range constant.Samples {
+		d := dynamic.Samples[i]
+		if s.Escaped != d.Escaped {
+			t.Fatalf("sample %d escaped = %v with a constant bailout, %v with a dynamic one", i, s.Escaped, d.Escaped)
+		}
+		if s.Escaped && s.N != d.N {
+			changed++
+		}
+	}
+	if changed == 0 {
+		t.Error("the dynamic bailout did not change any exterior iteration count")
+	}
+	if a, b := mustGenerate(t, testParameters(48, 48)), g.Colorize(dynamic, nil); bytes.Equal(a.Pix, b.Pix) {
+		t.Error("the dynamic bailout produced the same image")
+	}
+}
+
+func TestComputeFromMatchesFromScratch(t *testing.T) {
+	modes := map[string]func(p *Parameters){
+		"escape time":         func(p *Parameters) {},
+		"distance estimation": func(p *Parameters) { p.RenderOpts.DistanceEstimation = true },
+		"stalks":              func(p *Parameters) { p.RenderOpts.Coloring = ColoringPickoverStalks },
+	}
+	for name, mode := range modes {
+		p := testParameters(32, 24)
+		mode(&p)
+		p.RenderOpts.MaxIterations = 50
+		_, coarse := mustCompute(t, p)
+		if !slices.ContainsFunc(coarse.Samples, func(s Sample) bool { return s.periodic }) {
+			t.Fatalf("%s: no sample was found periodic", name)
+		}
+
+		p.RenderOpts.MaxIterations = 300
+		g, scratch := mustCompute(t, p)
+		warm, err := g.ComputeFrom(context.Background(), coarse)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := range scratch.Samples {
+			// 周期検出の状態も引き継ぐので、内部のサンプルも最初から計算したものと一致する
+			if a, b := warm.Samples[i], scratch.Samples[i]; a != b {
+				t.Fatalf("%s: sample %d resumed to %+v, from scratch %+v", name, i, a, b)
+			}
+		}
+
+		if !bytes.Equal(g.Colorize(warm, nil).Pix, g.Colorize(scratch, nil).Pix) {
+			t.Errorf("%s: warm-started image differs from the one computed from scratch", name)
+		}
+	}
+
+	p := testParameters(32, 24)
+	g, plain := mustCompute(t, p)
+	_, small := mustCompute(t, testParameters(16, 24))
+	if _, err := g.ComputeFrom(context.Background(), small); err == nil {
+		t.Error("ComputeFrom accepted a field of a different size")
+	}
+
+	// 途中の状態が異なる設定で計算した Field からは再開しない
+	mismatches := map[string]func(p *Parameters){
+		"distance estimation": modes["distance estimation"],
+		"stalks":              modes["stalks"],
+		"periodicity":         func(p *Parameters) { p.RenderOpts.PeriodicityEpsilon = 0 },
+	}
+	for name, mode := range mismatches {
+		q := p
+		mode(&q)
+		if _, err := mustGenerator(t, q).ComputeFrom(context.Background(), plain); !errors.Is(err, ErrInvalidParameters) {
+			t.Errorf("%s: ComputeFrom from a plain field: err = %v, want ErrInvalidParameters", name, err)
+		}
+	}
+}
+
+func TestCycleCountRepeatsPalette(t *testing.T) {
+	// 観測された反復回数の範囲で、パレットの位置が 0 から CycleCount まで進む
+	span := func(cycles int) (lo, hi float64) {
+		p := testParameters(32, 32)
+		p.RenderOpts.CycleCount = cycles
+		g, f := mustCompute(t, p)
+		c := colorizer{maxN: p.RenderOpts.MaxIterations}
+		c.minN, c.maxN = f.escapeRange()
+		lo, hi = math.Inf(1), math.Inf(-1)
+		for _, s := range f.Samples {
+			if s.Escaped {
+				i := g.paletteIndex(s, c)
+				lo, hi = math.Min(lo, i), math.Max(hi, i)
+			}
+		}
+		return lo, hi
+	}
+
+	lo1, hi1 := span(1)
+	lo2, hi2 := span(2)
+	if lo1 != 0 || lo2 != 0 {
+		t.Errorf("palette starts at %g and %g, want 0", lo1, lo2)
+	}
+	if hi1 != 1 || hi2 != 2 {
+		t.Errorf("palette spans %g cycles with CycleCount=1 and %g with CycleCount=2", hi1, hi2)
+	}
+}
+
+func TestAnalyticAACoverage(t *testing.T) {
+	p := testParameters(48, 48)
+	p.RenderOpts.AnalyticAA = true
+	p.RenderOpts.Bailout = func(int) float64 { return 1000 }
+	g, f := mustCompute(t, p)
+	if f.SamplesPerPixel != 1 {
+		t.Fatalf("AnalyticAA uses %d samples per pixel, want 1", f.SamplesPerPixel)
+	}
+
+	var partial int
+	for _, s := range f.Samples {
+		if c := g.boundaryCoverage(s); s.Escaped && c > 0 && c < 1 {
+			partial++
+		}
+	}
+	if partial == 0 {
+		t.Error("no exterior pixel has intermediate coverage")
+	}
+
+	// 部分的に覆われたピクセルは、外部の色と内部の黒の間の色になる
+	img := g.Colorize(f, nil)
+	p.RenderOpts.AnalyticAA = false
+	plain := mustGenerator(t, p)
+	var darker int
+	for py := 0; py < f.Height; py++ {
+		for px := 0; px < f.Width; px++ {
+			s := f.PixelSamples(px, py)[0]
+			if !s.Escaped || g.boundaryCoverage(s) <= 0 {
+				continue
+			}
+			c := plain.encoder().encode(plain.sampleColor(s, colorizer{maxN: p.RenderOpts.MaxIterations}).toLinear(), px, py)
+			if got := img.RGBAAt(px, py); int(got.R)+int(got.G)+int(got.B) < int(c.R)+int(c.G)+int(c.B) {
+				darker++
+			}
+		}
+	}
+	if darker == 0 {
+		t.Error("covered pixels are not blended towards the interior")
+	}
+}
+
+func TestSelectComponent(t *testing.T) {
+	// 外部 (反復 5 回) の中に、内部 (反復 200 回) の長方形が2つある Field
+	f := &Field{Width: 20, Height: 10, SamplesPerPixel: 1, Samples: make([]Sample, 200)}
+	region, other := image.Rect(2, 2, 9, 8), image.Rect(12, 2, 18, 8)
+	for py := 0; py < 10; py++ {
+		for px := 0; px < 20; px++ {
+			s := Sample{N: 5, Escaped: true}
+			if pt := image.Pt(px, py); pt.In(region) || pt.In(other) {
+				s = Sample{N: 200}
+			}
+			f.PixelSamples(px, py)[0] = s
+		}
+	}
+
+	mask := SelectComponent(f, image.Pt(4, 4), 3)
+	for py := 0; py < 10; py++ {
+		for px := 0; px < 20; px++ {
+			want := uint8(0)
+			if image.Pt(px, py).In(region) {
+				want = 255
+			}
+			if a := mask.AlphaAt(px, py).A; a != want {
+				t.Errorf("mask at (%d, %d) = %d, want %d", px, py, a, want)
+			}
+		}
+	}
+
+	if mask := SelectComponent(f, image.Pt(-1, 4), 3); !bytes.Equal(mask.Pix, make([]uint8, len(mask.Pix))) {
+		t.Error("start outside the field selected pixels")
+	}
+}
+
+// 内部の多いビューポートで、周期検出の許容誤差 eps を使ったときの画像と反復の総数を返す
+func periodicityRender(t *testing.T, eps float64) (*image.RGBA, int64) {
+	t.Helper()
+	p := testParameters(32, 32)
+	p.ViewPort.XMin, p.ViewPort.XMax = -0.6, 0.2
+	p.ViewPort.YMin, p.ViewPort.YMax = -0.4, 0.4
+	p.RenderOpts.MaxIterations = 2000
+	p.RenderOpts.PeriodicityEpsilon = eps
+	// 脱出半径は反復ごとに1度だけ問い合わせられるので、反復の総数を数えられる
+	var steps atomic.Int64
+	p.RenderOpts.Bailout = func(int) float64 {
+		steps.Add(1)
+		return 2
+	}
+	return mustGenerate(t, p), steps.Load()
+}
+
+func TestPeriodicityEpsilon(t *testing.T) {
+	exact, exactSteps := periodicityRender(t, 0)
+	tiny, _ := periodicityRender(t, 1e-300)
+	if !bytes.Equal(exact.Pix, tiny.Pix) {
+		t.Error("a tiny epsilon changed the image")
+	}
+
+	fast, fastSteps := periodicityRender(t, DefaultPeriodicityEpsilon)
+	if maxDiff, ok := CompareImages(exact, fast, 1); !ok {
+		t.Errorf("the default epsilon changed a channel by %d", maxDiff)
+	}
+	if fastSteps*2 > exactSteps {
+		t.Errorf("%d iterations with periodicity detection, %d without; want at most half", fastSteps, exactSteps)
+	}
+}
+
+func TestIterationOffsetAlignsExteriorColors(t *testing.T) {
+	frame := func(maxIterations, offset int) *Generator {
+		p := testParameters(32, 32)
+		p.RenderOpts.MaxIterations = maxIterations
+		p.RenderOpts.Contrast = 16
+		p.RenderOpts.IterationOffset = offset
+		return mustGenerator(t, p)
+	}
+
+	// MaxIterations が違っても、オフセットをそろえれば同じ点の外部の色は一致する
+	a, b := frame(100, 7), frame(300, 7)
+	var compared int
+	for _, z := range []complex128{-0.75 + 0.1i, -1.3 + 0.05i, 0.3 + 0.02i, -0.1 + 0.9i, 0.26, -2 + 1i} {
+		if !a.iterate(z).Escaped {
+			continue
+		}
+		compared++
+		if ca, cb := a.ColorAt(z), b.ColorAt(z); ca != cb {
+			t.Errorf("ColorAt(%v) = %v with MaxIterations 100, %v with 300", z, ca, cb)
+		}
+	}
+	if compared < 3 {
+		t.Fatalf("only %d points escaped", compared)
+	}
+
+	// Contrast 16 ではオフセット 16 でパレットがちょうど1周する
+	base := mustGenerate(t, frame(100, 0).params)
+	if full := mustGenerate(t, frame(100, 16).params); !bytes.Equal(base.Pix, full.Pix) {
+		t.Error("an offset of one palette cycle changed the image")
+	}
+	if half := mustGenerate(t, frame(100, 8).params); bytes.Equal(base.Pix, half.Pix) {
+		t.Error("an offset of half a palette cycle did not change the image")
+	}
+
+	// 負のオフセットでも組み込みの配色は 256 周期で循環する
+	p := frame(100, -1).params
+	p.RenderOpts.Contrast = 1
+	negative := mustGenerate(t, p)
+	p.RenderOpts.IterationOffset = 255
+	if positive := mustGenerate(t, p); !bytes.Equal(negative.Pix, positive.Pix) {
+		t.Error("offsets -1 and 255 gave different images with Contrast 1")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Logger はレンダリングの診断情報を受け取る。keyvals はキーと値を交互に並べたもの
+// (log/slog と同じ形) で、*slog.Logger の Info などを包めばそのまま使える。
+// 複数のゴルーチンから同時に呼ばれることがある。
+// どのレンダリングも "render start" で始まり、成功すれば内部と判定したサンプルの割合
+// (interiorFraction) を含む "render end" で終わる。
+type Logger interface {
+	Log(event string, keyvals ...any)
+}
+
+// Logger が設定されていれば event を送る。頻繁に呼ぶ場所では、引数を作る前に
+// g.params.Logger が nil かどうかを確かめること。
+func (g *Generator) log(event string, keyvals ...any) {
+	if l := g.params.Logger; l != nil {
+		l.Log(event, keyvals...)
+	}
+}
+
+// レンダリングの開始を送り、終了時に呼ぶ関数と、内部のサンプルを数えるカウンタを返す。
+// 終了時には経過時間と内部と判定したサンプルの割合を、失敗した場合はエラー
+// (中断なら "render canceled") を送る。Logger が nil の場合、カウンタは nil になる。
+func (g *Generator) logRender(kind string) (func(err error), *interiorCounter) {
+	if g.params.Logger == nil {
+		return func(error) {}, nil
+	}
+	start := time.Now()
+	interior := &interiorCounter{}
+	g.log("render start", "kind", kind, "width", g.params.Size.Width, "height", g.params.Size.Height,
+		"samples", g.samplesPerPixel(), "maxIterations", g.params.RenderOpts.MaxIterations)
+	return func(err error) {
+		elapsed := time.Since(start)
+		switch {
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+			g.log("render canceled", "kind", kind, "duration", elapsed, "error", err)
+		case err != nil:
+			g.log("render failed", "kind", kind, "duration", elapsed, "error", err)
+		default:
+			g.log("render end", "kind", kind, "duration", elapsed, "interiorFraction", interior.fraction())
+		}
+	}, interior
+}
+
+// interiorCounter はレンダリング中のサンプル数と、そのうち内部と判定した数を数える。
+// 複数のワーカーから同時に使える。nil のカウンタには何もしない。
+type interiorCounter struct {
+	samples, interior atomic.Int64
+}
+
+// サンプル s を数える
+func (c *interiorCounter) add(s Sample) {
+	if c == nil {
+		return
+	}
+	c.samples.Add(1)
+	if !s.Escaped {
+		c.interior.Add(1)
+	}
+}
+
+// 内部と判定したサンプルの割合 (上限まで反復したものと、周期検出で打ち切ったものを含む) を返す
+func (c *interiorCounter) fraction() float64 {
+	n := c.samples.Load()
+	if n == 0 {
+		return 0
+	}
+	return float64(c.interior.Load()) / float64(n)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 受け取ったイベントを順に記録する Logger
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+	// events と同じ順に、各イベントのキーと値
+	fields []map[string]any
+}
+
+func (r *eventRecorder) Log(event string, keyvals ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	fields := make(map[string]any)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[keyvals[i].(string)] = keyvals[i+1]
+	}
+	r.fields = append(r.fields, fields)
+}
+
+func TestLoggerReceivesRenderEvents(t *testing.T) {
+	var rec eventRecorder
+	p := testParameters(32, 24)
+	p.Logger = &rec
+	mustGenerate(t, p)
+
+	if want := []string{"render start", "render end"}; !slices.Equal(rec.events, want) {
+		t.Errorf("Generate logged %q, want %q", rec.events, want)
+	}
+	for i, f := range rec.fields {
+		if f["kind"] != "image" {
+			t.Errorf("Generate logged %q with kind %v, want image", rec.events[i], f["kind"])
+		}
+	}
+
+	rec = eventRecorder{}
+	mustCompute(t, p)
+	if want := []string{"render start", "render end"}; !slices.Equal(rec.events, want) {
+		t.Errorf("Compute logged %q, want %q", rec.events, want)
+	}
+}
+
+func TestLoggerReceivesInteriorFraction(t *testing.T) {
+	p := testParameters(50, 37)
+	g, f := mustCompute(t, p)
+	want := g.Stats(f, 0).InteriorFraction
+
+	renders := map[string]func(g *Generator) error{
+		"Compute": func(g *Generator) error {
+			_, err := g.Compute(context.Background())
+			return err
+		},
+		"Generate": func(g *Generator) error {
+			_, err := g.Generate(context.Background())
+			return err
+		},
+		"GenerateTiles": func(g *Generator) error {
+			return g.GenerateTiles(context.Background(), 16, func(image.Point, *image.RGBA) {})
+		},
+	}
+	for name, render := range renders {
+		var rec eventRecorder
+		q := p
+		q.Logger = &rec
+		if err := render(mustGenerator(t, q)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// どの経路でも同じサンプルを計算するので、Stats と同じ割合になる
+		end := rec.fields[len(rec.fields)-1]
+		if got, ok := end["interiorFraction"].(float64); !ok || got != want {
+			t.Errorf("%s: render end has interiorFraction %v, want %g", name, end["interiorFraction"], want)
+		}
+	}
+}
+
+func TestLoggerReceivesTileEvents(t *testing.T) {
+	var rec eventRecorder
+	p := testParameters(50, 37)
+	p.Logger = &rec
+	err := mustGenerator(t, p).GenerateTiles(context.Background(), 16, func(image.Point, *image.RGBA) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.events) != 2+12 || rec.events[0] != "render start" || rec.events[len(rec.events)-1] != "render end" {
+		t.Fatalf("GenerateTiles logged %q, want start, 12 tiles and end", rec.events)
+	}
+	for _, e := range rec.events[1 : len(rec.events)-1] {
+		if e != "tile" {
+			t.Errorf("unexpected event %q between start and end", e)
+		}
+	}
+
+	// タイルの大きさを自動で決める場合も、試しのレンダリングは記録しない
+	rec = eventRecorder{}
+	// fn は複数のワーカーから同時に呼ばれる
+	var tiles atomic.Int64
+	err = mustGenerator(t, p).GenerateTiles(context.Background(), 0, func(image.Point, *image.RGBA) { tiles.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := int(tiles.Load()); len(rec.events) != 2+n || rec.events[0] != "render start" || rec.events[len(rec.events)-1] != "render end" {
+		t.Fatalf("GenerateTiles with the automatic size logged %q, want start, %d tiles and end", rec.events, n)
+	}
+	for _, e := range rec.events[1 : len(rec.events)-1] {
+		if e != "tile" {
+			t.Errorf("unexpected event %q between start and end", e)
+		}
+	}
+}
+
+func TestLoggerReceivesCancellation(t *testing.T) {
+	var rec eventRecorder
+	p := testParameters(32, 24)
+	p.Logger = &rec
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := mustGenerator(t, p).Generate(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Generate with a canceled context: err = %v", err)
+	}
+	if want := []string{"render start", "render canceled"}; !slices.Equal(rec.events, want) {
+		t.Errorf("canceled Generate logged %q, want %q", rec.events, want)
+	}
+}
+
+func TestNilLoggerDoesNotAllocate(t *testing.T) {
+	g := mustGenerator(t, testParameters(32, 24))
+	allocs := testing.AllocsPerRun(100, func() {
+		done, _ := g.logRender("image")
+		done(nil)
+	})
+	if allocs != 0 {
+		t.Errorf("logging without a Logger allocates %g times per render", allocs)
+	}
+}
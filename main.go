@@ -1,25 +1,54 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/jpeg"
 	"image/png"
+	"maps"
+	"math"
+	"math/big"
 	"math/cmplx"
 	"os"
+	"runtime"
+	"slices"
 	"sync"
+	"time"
 )
 
 type Generator struct {
 	params Parameters
+
+	// ExactCoordinates 有効時に事前計算した各列・各行の座標
+	xs, ys []float64
 }
 
 type Parameters struct {
 	ViewPort struct {
 		XMin, YMin float64
 		XMax, YMax float64
+		// 虚軸の向き。既定 (false) は画面座標の向きで、YMin が画像の上端 (py=0) になる。
+		// true にすると数学の向きになり、YMax が上端になる (画像が上下反転する)。
+		MathOrientation bool
+		// true の場合は XMin == XMax や YMin == YMax を許し、幅のない線に沿ってレンダリングする
+		// (プロファイル用)。その軸ではすべてのピクセルとサンプルが同じ座標になる。
+		AllowDegenerate bool
+		// 有効な場合はピクセルの格子を (X, Y) を中心とする極座標に写す。ビューポートの
+		// 左端から右端が角度 0..2π、上端から下端が半径 RMin..RMax (対数の等間隔) になる。
+		// 写像は Warp の前に適用する。
+		Polar struct {
+			Enabled    bool
+			X, Y       float64
+			RMin, RMax float64
+		}
+		// 反復の前に各サンプル点の座標へ適用する変形 (渦巻きやレンズなど)。nil は恒等変換。
+		Warp func(complex128) complex128 `json:"-"`
 	}
 	Size struct {
 		Width  int
@@ -29,9 +58,134 @@ type Parameters struct {
 		SubPixelSamples int
 		MaxIterations   int
 		Contrast        int
+		// ピクセル中心の座標を有理数で厳密に計算し、最後に一度だけ丸める。
+		// 奇数サイズの画像では中央のピクセルがビューポートの中心と正確に一致する。
+		ExactCoordinates bool
+		// ピクセル内のサンプリングポイントの配置方法
+		Sampling SamplingStrategy
+		// ピクセルごとにサンプリング位置全体をずらす量 (ピクセル幅に対する割合, 0..1)。
+		// 深い拡大で周期的な構造が作るモアレを崩す。0 で無効。
+		PixelJitter float64
+		// SamplingBlueNoise で使う青色雑音のテクスチャ。赤と緑のチャンネルが横と縦のずれになる。
+		BlueNoise image.Image `json:"-"`
+		// 確率的なサンプリングに使う乱数のシード
+		Seed uint64
+		// ピクセル (px, py) の確率的なサンプリングに使う乱数源を返す。
+		// nil の場合は Seed とピクセル座標のハッシュから作る。
+		Random func(px, py int) RandomSource `json:"-"`
+		// 脱出したサンプルの色の決め方
+		Coloring ColoringMode
+		// 分割による配色 (ColoringBinaryDecomposition, ColoringSectorDecomposition) で使う色
+		DecompositionColors []color.RGBA
+		// ピックオーバーの茎 (ColoringPickoverStalks) の設定。軌道と実軸・虚軸との距離を
+		// それぞれ RealWeight, ImagWeight で割った値の最小が Width 未満のところが明るくなる。
+		// 重みが大きい軸ほど茎が太くなり、重みが 0 の軸は無視する。
+		Stalks struct {
+			RealWeight, ImagWeight float64
+			Width                  float64
+		}
+		// 境界の光 (ColoringDistanceGlow) の設定。境界から Width ピクセル離れるごとに
+		// 明るさが 1/e になる Color の光を、黒い背景に重ねる。
+		Glow struct {
+			Width float64
+			Color color.RGBA
+		}
+		// 脱出したサンプルの配色。nil の場合は組み込みの配色を使う。
+		Palette Palette `json:"-"`
+		// 反復回数 n に応じた脱出半径。nil の場合は常に 2 を使う。
+		// 2 以上を返す限り内部・外部の判定は変わらず、外部の模様だけが変わる。
+		Bailout func(n int) float64 `json:"-"`
+		// 距離推定のために反復中の導関数を追跡し、Sample.Derivative に記録する
+		DistanceEstimation bool
+		// 距離推定による解析的なアンチエイリアス。ピクセル中心の1点だけをサンプリングし、
+		// 境界までの推定距離から求めた被覆率で外部の色と内部の色を混ぜる。
+		// 推定の精度は脱出半径が大きいほど上がる (Bailout を参照)。
+		AnalyticAA bool
+		// 0 より大きい場合は Contrast の代わりに、反復回数の範囲全体でパレットが
+		// ちょうどこの回数だけ繰り返すように配色する。範囲は Colorize では Field 中で
+		// 実際に脱出したサンプルの最小・最大、それ以外では 0..MaxIterations になる。
+		CycleCount int
+		// 注目点の近くほど多く反復し、離れるほど反復を減らして細部の深さに差をつける。
+		// 点 z の反復回数の上限は MinIterations + (MaxIterations-MinIterations)*exp(-(d/Radius)^2)
+		// (d は (X, Y) からの距離) になる。
+		Focus struct {
+			Enabled       bool
+			X, Y          float64
+			Radius        float64
+			MinIterations int
+		}
+		// 周期検出の許容誤差。軌道が以前の値とこの距離以内に戻ったら周期的とみなし、
+		// 反復回数の上限まで回さずに内部と判定する。内部の多い画像で速くなるが、大きすぎると
+		// 境界近くの外部の点を内部と誤判定する。0 で周期検出を無効にする。
+		// 既定値は DefaultPeriodicityEpsilon。
+		PeriodicityEpsilon float64
+		// 画像の水平な帯だけを MaxIterations と SubPixelSamples で計算し、帯から離れるほど
+		// 反復回数の上限とサンプル数を減らす (ティルトシフト風)。Center と Height は画像の高さに対する
+		// 割合 (上端が 0) で帯の中心と高さを表し、帯の端から Falloff だけ離れたところで
+		// 上限が MinIterations、サンプル数が 1 まで下がる。反復回数は虚部で判定するので、
+		// Polar や Warp を使うと画像上の帯とは一致しない。サンプル数は Field の計算では減らさない。
+		// サンプル数は round(SubPixelSamples×品質) になるが、SamplingCorners は1点か4点しか
+		// 取らないので、帯から離れると途中で4点から1点に一度に変わる。段階的に減らすには
+		// SamplingCMJ などの他の配置を使う。
+		TiltShift struct {
+			Enabled        bool
+			Center, Height float64
+			Falloff        float64
+			MinIterations  int
+		}
+		// サンプルの平均をアルファ乗算済みの値で取る。半透明のサンプルを重ねて合成した結果に
+		// なり、透明に近いサンプルほど色への寄与が小さい。既定 (false) は色とアルファを別々に
+		// 平均する (透明なサンプルの色は黒として数える)。不透明なサンプルだけなら両者は一致する。
+		PremultipliedAverage bool
+		// 線形光の値を 8bit に変換するときの出力ガンマ。途中の計算はすべて線形光で行い、
+		// 符号化はこの値で最後に一度だけ行う。0 は sRGB の変換式、それ以外は 1/OutputGamma 乗。
+		OutputGamma float64
+		// 8bit に丸める前に順序ディザをかけ、滑らかなグラデーションの縞 (バンディング) を目立たなくする。
+		// SubPixelSamples = 1 の下書きと組み合わせれば、スーパーサンプリングなしでも縞の少ない画像になる。
+		Dither bool
+		// 行やタイルを並列に処理するワーカーの数。0 以下は runtime.NumCPU() を使う。
+		Workers int
+		// 配色の前に反復回数へ足す値。パレットの位相をずらす。MaxIterations を変えながら
+		// アニメーションを作るとき、フレームごとに合わせて変えれば外部の色の揺れを抑えられる。
+		IterationOffset int
+		// 何ピクセルごとにコンテキストの中断を確認するか。0 以下は毎ピクセル確認する。
+		// 大きくするとループ内の select が減るが、中断が効くまでに最大でこのピクセル数だけ遅れる。
+		CancelCheckInterval int
 	}
+	Tiles struct {
+		// GenerateTiles でタイルを処理する順序
+		Order TileOrder
+		// 1タイルあたりの時間の目安。超えたタイルは残りのピクセルを1サンプルで粗く計算する。
+		// 0 の場合は制限しない。
+		Budget time.Duration
+	}
+	PostProcess struct {
+		// 1サンプルの画像からエッジを検出して形状に応じて混色する形態的アンチエイリアス (MLAA)
+		MLAA struct {
+			Enabled   bool
+			Threshold float64 // エッジとみなす輝度差 (0..1)
+		}
+		// 明るい外部領域をぼかして加算するブルーム効果
+		Bloom struct {
+			Enabled   bool
+			Threshold float64 // 抽出する輝度のしきい値 (線形, 0..1)
+			Intensity float64 // 加算する強さ
+			Radius    float64 // ガウスぼかしの標準偏差 (ピクセル)
+		}
+		// 画像に内接する円 (正方形でない画像では楕円) の外を透明にするメダリオン風の切り抜き
+		Crop struct {
+			Enabled bool
+			Feather float64 // 縁をぼかす幅 (ピクセル)。1 で縁のアンチエイリアスだけになる。
+		}
+	}
+	// レンダリングの開始・終了やタイルごとの時間などを受け取る。nil なら何も記録しない。
+	Logger Logger `json:"-"`
 }
 
+// DefaultPeriodicityEpsilon は PeriodicityEpsilon の既定値。
+// float64 の丸め誤差よりは大きく、既定のビューポートでは周期検出なしの結果と変わらない。
+const DefaultPeriodicityEpsilon = 1e-12
+
 // 不正なパラメータが指定された場合のエラー
 var ErrInvalidParameters = errors.New("invalid parameters")
 
@@ -45,20 +199,59 @@ func NewDefaultParameters() Parameters {
 	p.Size.Height = 1024
 	p.RenderOpts.SubPixelSamples = 4
 	p.RenderOpts.MaxIterations = 200
-	p.RenderOpts.Contrast = 15
+	p.RenderOpts.Contrast = DefaultContrast(p.RenderOpts.MaxIterations)
+	p.RenderOpts.PeriodicityEpsilon = DefaultPeriodicityEpsilon
+	p.RenderOpts.Stalks.RealWeight = 1
+	p.RenderOpts.Stalks.ImagWeight = 1
+	p.RenderOpts.Stalks.Width = 0.05
+	p.RenderOpts.Glow.Width = 2
+	p.RenderOpts.Glow.Color = color.RGBA{R: 64, G: 255, B: 224, A: 255}
+	p.RenderOpts.DecompositionColors = []color.RGBA{
+		{R: 255, G: 255, B: 255, A: 255},
+		{A: 255},
+	}
+	p.PostProcess.MLAA.Threshold = 0.1
+	p.PostProcess.Bloom.Threshold = 0.6
+	p.PostProcess.Bloom.Intensity = 0.8
+	p.PostProcess.Bloom.Radius = 4
+	p.PostProcess.Crop.Feather = 1
 	return p
 }
 
+// DefaultContrast は maxIterations に見合った Contrast を返す。
+// 配色は Contrast*n で進むため、反復回数の上限に反比例させて色の変化の幅をそろえる。
+// 既定の 200 回では 15 になる。
+func DefaultContrast(maxIterations int) int {
+	return max(1, (3000+maxIterations/2)/max(1, maxIterations))
+}
+
 func NewGenerator(params Parameters) (*Generator, error) {
 	if err := validateParameters(params); err != nil {
 		return nil, fmt.Errorf("invalid parameters: %w", err)
 	}
-	return &Generator{params: params}, nil
+	g := &Generator{params: params}
+	if params.RenderOpts.ExactCoordinates {
+		g.xs = exactCoords(params.ViewPort.XMin, params.ViewPort.XMax, params.Size.Width)
+		g.ys = exactCoords(params.ViewPort.YMin, params.ViewPort.YMax, params.Size.Height)
+	}
+	return g, nil
 }
 
 func validateParameters(p Parameters) error {
-	if p.ViewPort.XMax <= p.ViewPort.XMin || p.ViewPort.YMax <= p.ViewPort.YMin {
-		return fmt.Errorf("%w: invalid viewport range", ErrInvalidParameters)
+	vp := p.ViewPort
+	if err := validateRange("X", vp.XMin, vp.XMax, vp.AllowDegenerate); err != nil {
+		return err
+	}
+	if err := validateRange("Y", vp.YMin, vp.YMax, vp.AllowDegenerate); err != nil {
+		return err
+	}
+	if pl := vp.Polar; pl.Enabled {
+		if vp.XMin == vp.XMax || vp.YMin == vp.YMax {
+			return fmt.Errorf("%w: polar mapping needs a non-degenerate viewport", ErrInvalidParameters)
+		}
+		if !(pl.RMin > 0 && pl.RMax > pl.RMin) {
+			return fmt.Errorf("%w: invalid polar radius range", ErrInvalidParameters)
+		}
 	}
 	if p.Size.Width <= 0 || p.Size.Height <= 0 {
 		return fmt.Errorf("%w: invalid image size", ErrInvalidParameters)
@@ -66,133 +259,764 @@ func validateParameters(p Parameters) error {
 	if p.RenderOpts.SubPixelSamples <= 0 {
 		return fmt.Errorf("%w: invalid subpixel samples", ErrInvalidParameters)
 	}
+	if p.RenderOpts.PixelJitter < 0 || p.RenderOpts.PixelJitter > 1 {
+		return fmt.Errorf("%w: invalid pixel jitter", ErrInvalidParameters)
+	}
+	if p.RenderOpts.Sampling < SamplingCorners || p.RenderOpts.Sampling > SamplingBlueNoise {
+		return fmt.Errorf("%w: unknown sampling strategy", ErrInvalidParameters)
+	}
+	if p.RenderOpts.Sampling == SamplingBlueNoise && (p.RenderOpts.BlueNoise == nil || p.RenderOpts.BlueNoise.Bounds().Empty()) {
+		return fmt.Errorf("%w: blue noise sampling needs a texture", ErrInvalidParameters)
+	}
+	switch p.RenderOpts.Coloring {
+	case ColoringEscapeTime:
+	case ColoringBinaryDecomposition:
+		if len(p.RenderOpts.DecompositionColors) < 2 {
+			return fmt.Errorf("%w: binary decomposition needs two colors", ErrInvalidParameters)
+		}
+	case ColoringPickoverStalks:
+		st := p.RenderOpts.Stalks
+		if st.Width <= 0 || st.RealWeight < 0 || st.ImagWeight < 0 || st.RealWeight+st.ImagWeight == 0 {
+			return fmt.Errorf("%w: invalid pickover stalk settings", ErrInvalidParameters)
+		}
+	case ColoringSectorDecomposition:
+		if len(p.RenderOpts.DecompositionColors) == 0 {
+			return fmt.Errorf("%w: sector decomposition needs at least one color", ErrInvalidParameters)
+		}
+	case ColoringDistanceGlow:
+		if p.RenderOpts.Glow.Width <= 0 {
+			return fmt.Errorf("%w: invalid glow width", ErrInvalidParameters)
+		}
+	default:
+		return fmt.Errorf("%w: unknown coloring mode", ErrInvalidParameters)
+	}
+	if p.Tiles.Order < TileOrderRowMajor || p.Tiles.Order > TileOrderHilbert {
+		return fmt.Errorf("%w: unknown tile order", ErrInvalidParameters)
+	}
+	if f := p.RenderOpts.Focus; f.Enabled {
+		if f.Radius <= 0 {
+			return fmt.Errorf("%w: invalid focus radius", ErrInvalidParameters)
+		}
+		if f.MinIterations <= 0 || f.MinIterations > p.RenderOpts.MaxIterations {
+			return fmt.Errorf("%w: focus MinIterations must be between 1 and MaxIterations", ErrInvalidParameters)
+		}
+	}
+	if ts := p.RenderOpts.TiltShift; ts.Enabled {
+		if vp.YMin == vp.YMax || ts.Height < 0 || ts.Falloff <= 0 {
+			return fmt.Errorf("%w: invalid tilt-shift band", ErrInvalidParameters)
+		}
+		if ts.MinIterations <= 0 || ts.MinIterations > p.RenderOpts.MaxIterations {
+			return fmt.Errorf("%w: tilt-shift MinIterations must be between 1 and MaxIterations", ErrInvalidParameters)
+		}
+	}
+	if p.RenderOpts.PeriodicityEpsilon < 0 || math.IsNaN(p.RenderOpts.PeriodicityEpsilon) {
+		return fmt.Errorf("%w: invalid periodicity epsilon", ErrInvalidParameters)
+	}
+	if p.RenderOpts.OutputGamma < 0 || math.IsNaN(p.RenderOpts.OutputGamma) {
+		return fmt.Errorf("%w: invalid output gamma", ErrInvalidParameters)
+	}
+	if m := p.PostProcess.MLAA; m.Enabled && (m.Threshold <= 0 || m.Threshold > 1) {
+		return fmt.Errorf("%w: invalid MLAA threshold", ErrInvalidParameters)
+	}
+	if b := p.PostProcess.Bloom; b.Enabled {
+		if b.Threshold < 0 || b.Threshold > 1 || b.Intensity < 0 || b.Radius <= 0 {
+			return fmt.Errorf("%w: invalid bloom options", ErrInvalidParameters)
+		}
+	}
+	if c := p.PostProcess.Crop; c.Enabled && c.Feather <= 0 {
+		return fmt.Errorf("%w: invalid crop feather", ErrInvalidParameters)
+	}
 	return nil
 }
 
+// ビューポートの1つの軸の範囲を検証する
+func validateRange(axis string, lo, hi float64, allowDegenerate bool) error {
+	if hi > lo || (allowDegenerate && hi == lo) {
+		return nil
+	}
+	if hi == lo {
+		return fmt.Errorf("%w: invalid viewport range: %s axis is degenerate (%sMin = %sMax = %g)",
+			ErrInvalidParameters, axis, axis, axis, lo)
+	}
+	return fmt.Errorf("%w: invalid viewport range: %sMax (%g) is less than %sMin (%g)",
+		ErrInvalidParameters, axis, hi, axis, lo)
+}
+
 // point はサンプリングポイントを表す
 type point struct {
 	x, y float64
 }
 
+// renderJob は1回のレンダリングに固有の入力をまとめる
+type renderJob struct {
+	// skipMask の不透明なピクセルは反復計算せず fill で塗る
+	skipMask *image.Alpha
+	fill     fcolor
+	// nil でなければ、アルファが 0 のピクセルを1サンプルだけで計算する
+	supersampleMask *image.Alpha
+	// nil でなければ、計算したサンプルを数える (Logger を参照)
+	interior *interiorCounter
+}
+
 func (g *Generator) Generate(ctx context.Context) (*image.RGBA, error) {
-	img := image.NewRGBA(image.Rect(0, 0, g.params.Size.Width, g.params.Size.Height))
+	img, err := g.generate(ctx, renderJob{})
+	if err != nil {
+		return nil, err
+	}
+	return img.toRGBA(g.encoder()), nil
+}
 
-	samplingWidth := 0.5 / float64(g.params.Size.Width) * (g.params.ViewPort.XMax - g.params.ViewPort.XMin)
-	samplingHeight := 0.5 / float64(g.params.Size.Height) * (g.params.ViewPort.YMax - g.params.ViewPort.YMin)
+// GenerateWithHash は Generate と同じ画像と、そのピクセル列 (RGBA の Pix) の SHA-256 を
+// 16進文字列で返す。内容をキーにしたキャッシュに使う。
+func (g *Generator) GenerateWithHash(ctx context.Context) (*image.RGBA, string, error) {
+	img, err := g.Generate(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(img.Pix)
+	return img, hex.EncodeToString(sum[:]), nil
+}
 
-	var wg sync.WaitGroup
-	errChan := make(chan error, g.params.Size.Height)
+// GenerateInto はレンダリング結果を dst の origin を左上とする領域に直接書き込む。
+// テクスチャアトラスに詰める場合などに使い、領域の外のピクセルは変更しない。
+func (g *Generator) GenerateInto(ctx context.Context, dst *image.RGBA, origin image.Point) error {
+	r := image.Rectangle{Min: origin, Max: origin.Add(image.Pt(g.params.Size.Width, g.params.Size.Height))}
+	if !r.In(dst.Bounds()) {
+		return fmt.Errorf("%w: destination region %v is outside %v", ErrInvalidParameters, r, dst.Bounds())
+	}
 
-	// 各行を並列処理
-	for py := 0; py < g.params.Size.Height; py++ {
+	img, err := g.generate(ctx, renderJob{})
+	if err != nil {
+		return err
+	}
+	img.drawInto(dst, origin, g.encoder())
+	return nil
+}
+
+// GenerateMasked は mask のアルファが 0 でないピクセルを計算せずに fill で塗りつぶす。
+// 前回のパスで不要と分かっている領域を省くのに使う。
+func (g *Generator) GenerateMasked(ctx context.Context, mask *image.Alpha, fill color.Color) (*image.RGBA, error) {
+	if fill == nil {
+		fill = color.Transparent
+	}
+	img, err := g.generate(ctx, renderJob{skipMask: mask, fill: toFColor(fill).toLinear()})
+	if err != nil {
+		return nil, err
+	}
+	return img.toRGBA(g.encoder()), nil
+}
+
+// GenerateSupersampled は mask のアルファが 0 でないピクセルだけをスーパーサンプリングし、
+// 残りのピクセルは1サンプルだけで計算する。外部のエッジ検出などで品質を上げる場所を指定するのに使う。
+func (g *Generator) GenerateSupersampled(ctx context.Context, mask *image.Alpha) (*image.RGBA, error) {
+	img, err := g.generate(ctx, renderJob{supersampleMask: mask})
+	if err != nil {
+		return nil, err
+	}
+	return img.toRGBA(g.encoder()), nil
+}
+
+func (g *Generator) generate(ctx context.Context, job renderJob) (img *floatImage, err error) {
+	done, interior := g.logRender("image")
+	defer func() { done(err) }()
+	job.interior = interior
+
+	img = newFloatImage(g.params.Size.Width, g.params.Size.Height)
+
+	samplingWidth, samplingHeight := g.samplingStep()
+
+	err = g.forEachRow(func(py int) error {
+		return g.processRow(ctx, py, img, job, samplingWidth, samplingHeight)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error processing row: %w", err)
+	}
+
+	g.postProcess(img)
+	return img, nil
+}
+
+// 各行を Workers 個のワーカーで並列処理し、最初に見つかったエラーを返す。
+// エラーになった行があっても残りの行は処理する。
+func (g *Generator) forEachRow(fn func(py int) error) error {
+	workers := min(g.workers(), g.params.Size.Height)
+	rows := make(chan int)
+	// 各ワーカーは最初のエラーだけを送るので、ワーカー数の大きさで足りる
+	errChan := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
 		wg.Add(1)
-		go func(py int) {
+		go func() {
 			defer wg.Done()
-			if err := g.processRow(ctx, py, img, samplingWidth, samplingHeight); err != nil {
-				errChan <- err
+			var first error
+			for py := range rows {
+				if err := fn(py); err != nil && first == nil {
+					first = err
+				}
+			}
+			if first != nil {
+				errChan <- first
 			}
-		}(py)
+		}()
 	}
 
+	for py := 0; py < g.params.Size.Height; py++ {
+		rows <- py
+	}
+	close(rows)
 	wg.Wait()
 	close(errChan)
 
 	for err := range errChan {
 		if err != nil {
-			return nil, fmt.Errorf("error processing row: %w", err)
+			return err
 		}
 	}
+	return nil
+}
 
-	return img, nil
+// 並列に処理するワーカーの数を返す
+func (g *Generator) workers() int {
+	if n := g.params.RenderOpts.Workers; n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
 }
 
-// 1行分のピクセルを処理する
-func (g *Generator) processRow(ctx context.Context, py int, img *image.RGBA, samplingWidth, samplingHeight float64) error {
-	y := float64(py)/float64(g.params.Size.Height)*(g.params.ViewPort.YMax-g.params.ViewPort.YMin) + g.params.ViewPort.YMin
+// サンプリング点同士の間隔を返す
+func (g *Generator) samplingStep() (samplingWidth, samplingHeight float64) {
+	samplingWidth = 0.5 / float64(g.params.Size.Width) * (g.params.ViewPort.XMax - g.params.ViewPort.XMin)
+	samplingHeight = 0.5 / float64(g.params.Size.Height) * (g.params.ViewPort.YMax - g.params.ViewPort.YMin)
+	return samplingWidth, samplingHeight
+}
+
+// 最後の 8bit への変換の設定を返す
+func (g *Generator) encoder() encoder {
+	return encoder{gamma: g.params.RenderOpts.OutputGamma, dither: g.params.RenderOpts.Dither}
+}
+
+// レンダリング後の後処理を適用する
+func (g *Generator) postProcess(img *floatImage) {
+	if m := g.params.PostProcess.MLAA; m.Enabled {
+		applyMLAA(img, m.Threshold)
+	}
+	if b := g.params.PostProcess.Bloom; b.Enabled {
+		applyBloom(img, b.Threshold, b.Intensity, b.Radius)
+	}
+	if c := g.params.PostProcess.Crop; c.Enabled {
+		applyEllipseCrop(img, c.Feather)
+	}
+}
 
+// 1行分のピクセルを処理する
+func (g *Generator) processRow(ctx context.Context, py int, img *floatImage, job renderJob, samplingWidth, samplingHeight float64) error {
+	cancel := g.newCancelChecker(ctx)
 	for px := 0; px < g.params.Size.Width; px++ {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			x := float64(px)/float64(g.params.Size.Width)*(g.params.ViewPort.XMax-g.params.ViewPort.XMin) + g.params.ViewPort.XMin
-			samples := g.getSamples(x, y, samplingWidth, samplingHeight)
-			avgColor := averageColors(samples)
-			img.Set(px, py, avgColor)
+		if err := cancel.check(); err != nil {
+			return err
 		}
+		img.set(px, py, g.renderPixel(px, py, job, samplingWidth, samplingHeight))
 	}
-	return nil
+	return cancel.done()
+}
+
+// cancelChecker は最初のピクセルと、その後 CancelCheckInterval ピクセルごとにだけコンテキストの中断を確認する。
+// 行やタイルごとに作り直すので、終わりには必ず done を呼んで残りの分を確認する。
+type cancelChecker struct {
+	ctx   context.Context
+	every int
+	count int
+}
+
+func (g *Generator) newCancelChecker(ctx context.Context) *cancelChecker {
+	every := max(1, g.params.RenderOpts.CancelCheckInterval)
+	// 中断後に始まった行やタイルは1ピクセルも処理しないように、最初の check で確認する
+	return &cancelChecker{ctx: ctx, every: every, count: every - 1}
+}
+
+// 1ピクセル処理するごとに呼ぶ。中断されていればそのエラーを返す。
+func (c *cancelChecker) check() error {
+	c.count++
+	if c.count < c.every {
+		return nil
+	}
+	c.count = 0
+	select {
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// 行やタイルの処理を終えたときに呼ぶ。間隔に関係なく中断を確認し、中断されていればそのエラーを返す。
+// 間隔が行やタイルのピクセル数より大きくても、中断が見逃されないようにする。
+func (c *cancelChecker) done() error {
+	c.count = 0
+	return c.ctx.Err()
+}
+
+// 1ピクセル分の色を線形光で計算する。サンプルの色は線形光に直してから平均するので、
+// sRGB の値のまま平均するより境界の明るさが正しくなる。
+func (g *Generator) renderPixel(px, py int, job renderJob, samplingWidth, samplingHeight float64) fcolor {
+	if job.skipMask != nil && job.skipMask.AlphaAt(px, py).A != 0 {
+		return job.fill
+	}
+	if job.supersampleMask != nil && job.supersampleMask.AlphaAt(px, py).A == 0 {
+		return g.coarsePixel(px, py, job.interior)
+	}
+	samples := g.getSamples(px, py, samplingWidth, samplingHeight, job.interior)
+	for i, c := range samples {
+		samples[i] = c.toLinear()
+	}
+	return averageColors(samples, g.params.RenderOpts.PremultipliedAverage)
+}
+
+// ピクセル (px, py) の中心の複素平面上の座標を返す。
+// ExactCoordinates の有無にかかわらず同じ点を返し、サンプリングはここからのずれで決める。
+func (g *Generator) pixelCoord(px, py int) (x, y float64) {
+	if g.params.ViewPort.MathOrientation {
+		py = g.params.Size.Height - 1 - py
+	}
+	if g.xs != nil {
+		return g.xs[px], g.ys[py]
+	}
+	vp := g.params.ViewPort
+	x = (float64(px)+0.5)/float64(g.params.Size.Width)*(vp.XMax-vp.XMin) + vp.XMin
+	y = (float64(py)+0.5)/float64(g.params.Size.Height)*(vp.YMax-vp.YMin) + vp.YMin
+	return x, y
+}
+
+// ビューポート上の点 (x, y) に Polar と Warp を順に適用し、反復に使う座標を返す
+func (g *Generator) mapPoint(x, y float64) complex128 {
+	z := complex(x, y)
+	vp := g.params.ViewPort
+	if pl := vp.Polar; pl.Enabled {
+		u := (x - vp.XMin) / (vp.XMax - vp.XMin)
+		v := (y - vp.YMin) / (vp.YMax - vp.YMin)
+		r := pl.RMin * math.Pow(pl.RMax/pl.RMin, v)
+		z = complex(pl.X, pl.Y) + cmplx.Rect(r, 2*math.Pi*u)
+	}
+	if warp := vp.Warp; warp != nil {
+		z = warp(z)
+	}
+	return z
+}
+
+// PixelScale は1ピクセルが複素平面上で占める幅と高さを返す。
+// 既定の設定では、ピクセル (px, py) の中心は XMin + (px+1/2)*dx, YMin + (py+1/2)*dy に対応する。
+func (g *Generator) PixelScale() (dx, dy float64) {
+	vp := g.params.ViewPort
+	dx = (vp.XMax - vp.XMin) / float64(g.params.Size.Width)
+	dy = (vp.YMax - vp.YMin) / float64(g.params.Size.Height)
+	return dx, dy
+}
+
+// min + (i + 1/2) * (max - min) / n を有理数で計算し、float64 に丸めて返す
+func exactCoords(lo, hi float64, n int) []float64 {
+	rlo := new(big.Rat).SetFloat64(lo)
+	span := new(big.Rat).Sub(new(big.Rat).SetFloat64(hi), rlo)
+
+	coords := make([]float64, n)
+	for i := range coords {
+		t := big.NewRat(int64(2*i+1), int64(2*n))
+		v := new(big.Rat).Mul(t, span)
+		v.Add(v, rlo)
+		coords[i], _ = v.Float64()
+	}
+	return coords
 }
 
 // スーパーサンプリング用のカラーサンプルを取得する
-func (g *Generator) getSamples(x, y, samplingWidth, samplingHeight float64) []color.Color {
-	points := []point{
-		{x, y},
-		{x + samplingWidth, y},
-		{x + samplingWidth, y + samplingHeight},
-		{x, y + samplingHeight},
+func (g *Generator) getSamples(px, py int, samplingWidth, samplingHeight float64, interior *interiorCounter) []fcolor {
+	n := g.params.RenderOpts.SubPixelSamples
+	if g.params.RenderOpts.TiltShift.Enabled {
+		_, y := g.pixelCoord(px, py)
+		n = max(1, int(math.Round(float64(n)*g.tiltShiftQuality(y))))
 	}
+	points := g.samplePoints(px, py, n, samplingWidth, samplingHeight)
 
-	samples := make([]color.Color, 0, len(points))
+	samples := make([]fcolor, 0, len(points))
 	for _, p := range points {
-		samples = append(samples, g.mandelbrot(complex(p.x, p.y)))
+		samples = append(samples, g.mandelbrot(complex(p.x, p.y), interior))
 	}
 	return samples
 }
 
-func (g *Generator) mandelbrot(z complex128) color.Color {
-	var v complex128
-	for n := uint8(0); n < uint8(g.params.RenderOpts.MaxIterations); n++ {
+// ColorAt は複素平面上の点 z の1サンプル分の色を、画像のレンダリングと同じ彩色と
+// 出力ガンマで求める。Polar や Warp は適用せず、ディザもかけない。
+// 画像全体をレンダリングせずに1点の色を調べるのに使う。
+func (g *Generator) ColorAt(z complex128) color.Color {
+	return encoder{gamma: g.params.RenderOpts.OutputGamma}.encode(g.mandelbrot(z, nil).toLinear(), 0, 0)
+}
+
+// 点 z の1サンプル分の色を求める。interior が nil でなければサンプルを数える。
+func (g *Generator) mandelbrot(z complex128, interior *interiorCounter) fcolor {
+	c := colorizer{palette: g.params.RenderOpts.Palette, maxN: g.params.RenderOpts.MaxIterations}
+	s := g.iterate(z)
+	interior.add(s)
+	return g.sampleColor(s, c)
+}
+
+// z について漸化式を反復し、その結果を返す
+func (g *Generator) iterate(z complex128) Sample {
+	return g.resume(z, Sample{})
+}
+
+// resume は s に記録された値と反復回数から反復を続ける。
+// 脱出済みのサンプルと周期的と判定したサンプルは反復し直さない。
+func (g *Generator) resume(z complex128, s Sample) Sample {
+	if s.Escaped {
+		return s
+	}
+	if s.periodic {
+		// 周期的と判定した時点の値が最終の結果なので、反復回数の上限だけを新しくする
+		s.N = max(s.N, g.maxIterations(z))
+		return s
+	}
+	if g.tracksDerivative() {
+		return g.resumeWithDerivative(z, s)
+	}
+	v := s.Z
+	limit := g.maxIterations(z)
+	stalks, trap := g.startTrap(s)
+	period := g.startPeriodicity(s)
+	for n := s.N; n < limit; n++ {
 		v = v*v + z
-		if cmplx.Abs(v) > 2 {
-			return color.RGBA{
-				R: 64 - uint8(g.params.RenderOpts.Contrast)*n,
-				G: 80 - uint8(g.params.RenderOpts.Contrast)*n%128,
-				B: 240 + uint8(g.params.RenderOpts.Contrast)*n%64,
-				A: 255,
-			}
+		if stalks {
+			trap = min(trap, g.stalkDistance(v))
+		}
+		if cmplx.Abs(v) > g.bailout(n) {
+			return Sample{Z: v, N: n, Escaped: true, trap: trap}
+		}
+		if period.periodic(v) {
+			return Sample{Z: v, N: max(s.N, limit), trap: trap, period: period, periodic: true}
+		}
+	}
+	return Sample{Z: v, N: max(s.N, limit), trap: trap, period: period}
+}
+
+// 反復中に導関数を追跡するかどうかを返す
+func (g *Generator) tracksDerivative() bool {
+	return g.params.RenderOpts.DistanceEstimation || g.params.RenderOpts.AnalyticAA ||
+		g.params.RenderOpts.Coloring == ColoringDistanceGlow
+}
+
+// resume と同じ反復を行いながら、z についての導関数 dv/dz も追跡する
+func (g *Generator) resumeWithDerivative(z complex128, s Sample) Sample {
+	v, dv := s.Z, s.dz
+	limit := g.maxIterations(z)
+	stalks, trap := g.startTrap(s)
+	period := g.startPeriodicity(s)
+	for n := s.N; n < limit; n++ {
+		dv = 2*v*dv + 1
+		v = v*v + z
+		if stalks {
+			trap = min(trap, g.stalkDistance(v))
+		}
+		if cmplx.Abs(v) > g.bailout(n) {
+			return Sample{Z: v, N: n, Escaped: true, Derivative: cmplx.Abs(dv), dz: dv, trap: trap}
 		}
+		if period.periodic(v) {
+			return Sample{Z: v, N: max(s.N, limit), Derivative: cmplx.Abs(dv), dz: dv, trap: trap, period: period, periodic: true}
+		}
+	}
+	return Sample{Z: v, N: max(s.N, limit), Derivative: cmplx.Abs(dv), dz: dv, trap: trap, period: period}
+}
+
+// periodicity は Brent の方法で軌道が周期的になったことを検出する。
+// 比較の基準にする値を 1, 2, 4, ... 回ごとに更新するので、どの長さの周期もいずれ見つかる。
+type periodicity struct {
+	eps           float64
+	ref           complex128
+	steps, window int
+}
+
+// v から始まる軌道の周期検出を用意する
+func (g *Generator) newPeriodicity(v complex128) periodicity {
+	return periodicity{eps: g.params.RenderOpts.PeriodicityEpsilon, ref: v, window: 1}
+}
+
+// s から反復を再開するときの周期検出を返す。途中まで反復したサンプルは記録した状態から続けるので、
+// 最初から反復した場合と同じ時点で周期を検出する。
+func (g *Generator) startPeriodicity(s Sample) periodicity {
+	if s.N == 0 {
+		return g.newPeriodicity(s.Z)
+	}
+	return s.period
+}
+
+// 反復で得た値 v が基準の値に eps 以内で戻っていれば true を返す
+func (p *periodicity) periodic(v complex128) bool {
+	if p.eps <= 0 {
+		return false
+	}
+	if cmplx.Abs(v-p.ref) < p.eps {
+		return true
+	}
+	p.steps++
+	if p.steps == p.window {
+		p.steps, p.window, p.ref = 0, p.window*2, v
+	}
+	return false
+}
+
+// 点 z での反復回数の上限を返す (Focus と TiltShift を参照)。両方が有効なら少ない方になる。
+func (g *Generator) maxIterations(z complex128) int {
+	limit := g.params.RenderOpts.MaxIterations
+	if f := g.params.RenderOpts.Focus; f.Enabled {
+		d := cmplx.Abs(z-complex(f.X, f.Y)) / f.Radius
+		span := float64(g.params.RenderOpts.MaxIterations - f.MinIterations)
+		limit = f.MinIterations + int(math.Round(span*math.Exp(-d*d)))
+	}
+	if ts := g.params.RenderOpts.TiltShift; ts.Enabled {
+		span := float64(g.params.RenderOpts.MaxIterations - ts.MinIterations)
+		limit = min(limit, ts.MinIterations+int(math.Round(span*g.tiltShiftQuality(imag(z)))))
+	}
+	return limit
+}
+
+// 虚部 y の位置での TiltShift の品質 (帯の中で 1、帯から Falloff 以上離れると 0) を返す
+func (g *Generator) tiltShiftQuality(y float64) float64 {
+	ts := g.params.RenderOpts.TiltShift
+	if !ts.Enabled {
+		return 1
+	}
+	vp := g.params.ViewPort
+	t := (y - vp.YMin) / (vp.YMax - vp.YMin)
+	if vp.MathOrientation {
+		t = 1 - t
+	}
+	d := math.Abs(t-ts.Center) - ts.Height/2
+	if d <= 0 {
+		return 1
+	}
+	return math.Max(0, 1-d/ts.Falloff)
+}
+
+// n 回目の反復での脱出半径を返す
+func (g *Generator) bailout(n int) float64 {
+	if f := g.params.RenderOpts.Bailout; f != nil {
+		return f(n)
 	}
-	return color.Black
+	return 2
 }
 
-// 複数のサンプルから平均色を計算する
-func averageColors(colors []color.Color) color.Color {
+// colorizer は1回の彩色に共通する設定をまとめる
+type colorizer struct {
+	// nil の場合は組み込みの配色を使う
+	palette Palette
+	// CycleCount でパレットを繰り返す反復回数の範囲
+	minN, maxN int
+}
+
+// サンプルの反復結果を色に変換する
+func (g *Generator) sampleColor(s Sample, c colorizer) fcolor {
+	if !s.Escaped {
+		return fcolor{a: 1}
+	}
+	exterior := g.exteriorColor(s, c)
+	if g.params.RenderOpts.AnalyticAA {
+		return mix(exterior, fcolor{a: 1}, g.boundaryCoverage(s))
+	}
+	return exterior
+}
+
+// 脱出したサンプルの色を返す
+func (g *Generator) exteriorColor(s Sample, c colorizer) fcolor {
+	switch g.params.RenderOpts.Coloring {
+	case ColoringBinaryDecomposition:
+		return g.binaryDecompositionColor(s)
+	case ColoringPickoverStalks:
+		return g.pickoverStalksColor(s, c)
+	case ColoringDistanceGlow:
+		return g.distanceGlowColor(s)
+	case ColoringSectorDecomposition:
+		return g.sectorDecompositionColor(s)
+	}
+	return g.escapeTimeColor(s, c)
+}
+
+// 反復回数に応じた色を返す
+func (g *Generator) escapeTimeColor(s Sample, c colorizer) fcolor {
+	t := g.paletteIndex(s, c)
+	if c.palette != nil {
+		return toFColor(c.palette.Color(t))
+	}
+	// 組み込みの配色は各チャンネルが 256 周期で循環する。
+	// 8bit の演算に頼らず整数で剰余を取り、最後に 0..1 へ変換する。
+	// k は IterationOffset が負なら負になるので、剰余は常に 0 以上に直す
+	k := int(math.Round(t * 256))
+	mod := func(v, m int) int {
+		return (v%m + m) % m
+	}
+	channel := func(v int) float64 {
+		return float64(mod(v, 256)) / 255
+	}
+	return fcolor{
+		r: channel(64 - k),
+		g: channel(80 - mod(k, 128)),
+		b: channel(240 + mod(k, 64)),
+		a: 1,
+	}
+}
+
+// 脱出したサンプルについて、ピクセルのうち集合の内部が占める割合を距離推定から見積もる。
+// 境界が直線だとみなし、その直線からピクセル中心までの距離で被覆率を決める。
+func (g *Generator) boundaryCoverage(s Sample) float64 {
+	distance, ok := g.boundaryDistance(s)
+	if !ok {
+		return 0
+	}
+	return math.Max(0, math.Min(0.5-distance, 1))
+}
+
+// 脱出したサンプルから集合の境界までの推定距離をピクセル単位で返す。
+// 導関数が記録されていないなど推定できない場合は false を返す。
+func (g *Generator) boundaryDistance(s Sample) (float64, bool) {
+	r := cmplx.Abs(s.Z)
+	if s.Derivative == 0 || r <= 1 {
+		return 0, false
+	}
+	dx, dy := g.PixelScale()
+	return 0.5 * r * math.Log(r) / s.Derivative / math.Max(dx, dy), true
+}
+
+// パレットを参照する位置を返す。位置 1 ごとにパレットが1周する。
+// 反復回数には IterationOffset を足してから使う。
+func (g *Generator) paletteIndex(s Sample, c colorizer) float64 {
+	n := s.N + g.params.RenderOpts.IterationOffset
+	if cycles := g.params.RenderOpts.CycleCount; cycles > 0 {
+		if c.maxN <= c.minN {
+			return 0
+		}
+		return float64(cycles) * float64(n-c.minN) / float64(c.maxN-c.minN)
+	}
+	return float64(g.params.RenderOpts.Contrast*n) / 256
+}
+
+// 複数のサンプルから平均色を計算する。丸めは最後の 8bit 変換まで行わない。
+// サンプル数が多くても誤差がたまらないよう、補償付きの加算で合計する。
+// premultiplied の場合はアルファ乗算済みの値をそのまま平均し、そうでなければ
+// 色とアルファを別々に平均する (PremultipliedAverage を参照)。結果はどちらもアルファ乗算済み。
+func averageColors(colors []fcolor, premultiplied bool) fcolor {
 	if len(colors) == 0 {
-		return color.Black
+		return fcolor{a: 1}
 	}
 
-	var r, g, b, a uint32
+	var r, g, b, a kahanSum
 	for _, c := range colors {
-		cr, cg, cb, ca := c.RGBA()
-		r += cr
-		g += cg
-		b += cb
-		a += ca
+		if !premultiplied && c.a > 0 {
+			c.r, c.g, c.b = c.r/c.a, c.g/c.a, c.b/c.a
+		}
+		r.add(c.r)
+		g.add(c.g)
+		b.add(c.b)
+		a.add(c.a)
 	}
 
-	n := uint32(len(colors))
-	return color.RGBA{
-		R: uint8(r / n >> 8),
-		G: uint8(g / n >> 8),
-		B: uint8(b / n >> 8),
-		A: uint8(a / n >> 8),
+	n := float64(len(colors))
+	avg := fcolor{r: r.sum / n, g: g.sum / n, b: b.sum / n, a: a.sum / n}
+	if !premultiplied {
+		avg.r, avg.g, avg.b = avg.r*avg.a, avg.g*avg.a, avg.b*avg.a
 	}
+	return avg
+}
+
+// kahanSum は Kahan の補償付き加算で浮動小数点数を合計する
+type kahanSum struct {
+	sum float64
+	// これまでの加算で失われた下位の桁
+	c float64
+}
+
+func (k *kahanSum) add(v float64) {
+	y := v - k.c
+	t := k.sum + y
+	k.c = (t - k.sum) - y
+	k.sum = t
 }
 
 func SaveImage(img *image.RGBA, filename string) error {
-	f, err := os.Create(filename)
+	return SaveImageWithCompression(img, filename, png.DefaultCompression)
+}
+
+// SaveImageWithCompression は圧縮レベルを指定して PNG を保存する。
+// png.BestSpeed は書き出しが速く、png.BestCompression はファイルが小さくなる。
+func SaveImageWithCompression(img *image.RGBA, filename string, level png.CompressionLevel) error {
+	return savePNG(img, filename, level)
+}
+
+// 任意の形式の画像を PNG で保存する
+func savePNG(img image.Image, filename string, level png.CompressionLevel) error {
+	data, err := encodePNG(img, level)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
 	}
-	defer f.Close()
-
-	if err := png.Encode(f, img); err != nil {
-		return fmt.Errorf("failed to encode image: %w", err)
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
 	}
 	return nil
 }
 
+// EncodePNG はファイルを介さずに画像を既定の圧縮レベルの PNG にしたバイト列を返す。
+// HTTP で返す場合などに使う。SaveImage が書き出す内容と同じになる。
+func EncodePNG(img *image.RGBA) ([]byte, error) {
+	return encodePNG(img, png.DefaultCompression)
+}
+
+// EncodeJPEG は画像を品質 quality (1..100) の JPEG にしたバイト列を返す
+func EncodeJPEG(img *image.RGBA, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func encodePNG(img image.Image, level png.CompressionLevel) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: level}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SaveImages は複数の画像を並列に保存する。同時に書き込むファイル数は concurrency 個までに抑え、
+// 失敗したファイルのエラーをすべてまとめて返す。
+func SaveImages(images map[string]*image.RGBA, concurrency int) error {
+	return saveAll(images, concurrency, SaveImage)
+}
+
+// images の各画像を save で並列に保存する。同時に呼ぶ save は concurrency 個まで。
+func saveAll(images map[string]*image.RGBA, concurrency int, save func(*image.RGBA, string) error) error {
+	if concurrency <= 0 {
+		return fmt.Errorf("%w: invalid concurrency", ErrInvalidParameters)
+	}
+
+	filenames := slices.Sorted(maps.Keys(images))
+	errs := make([]error, len(filenames))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, filename := range filenames {
+		wg.Add(1)
+		go func(i int, filename string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := save(images[filename], filename); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", filename, err)
+			}
+		}(i, filename)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
 func main() {
 	params := NewDefaultParameters()
 	generator, err := NewGenerator(params)
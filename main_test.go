@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// テスト用の小さな画像のパラメータ
+func testParameters(w, h int) Parameters {
+	p := NewDefaultParameters()
+	p.Size.Width, p.Size.Height = w, h
+	return p
+}
+
+// loggerFunc は関数を Logger として使う
+type loggerFunc func(event string, keyvals ...any)
+
+func (f loggerFunc) Log(event string, keyvals ...any) { f(event, keyvals...) }
+
+func mustGenerator(t testing.TB, p Parameters) *Generator {
+	t.Helper()
+	g, err := NewGenerator(p)
+	if err != nil {
+		t.Fatalf("NewGenerator: %v", err)
+	}
+	return g
+}
+
+func mustGenerate(t testing.TB, p Parameters) *image.RGBA {
+	t.Helper()
+	img, err := mustGenerator(t, p).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	return img
+}
+
+func TestCancelCheckIntervalLargerThanRow(t *testing.T) {
+	p := testParameters(64, 64)
+	p.RenderOpts.CancelCheckInterval = 100
+	g := mustGenerator(t, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.Generate(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Generate error = %v, want context.Canceled", err)
+	}
+	err := g.GenerateTiles(ctx, 8, func(image.Point, *image.RGBA) {})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("GenerateTiles error = %v, want context.Canceled", err)
+	}
+	if _, err := g.Compute(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Compute error = %v, want context.Canceled", err)
+	}
+}
+
+func TestCancelTakesEffectWithinInterval(t *testing.T) {
+	const interval, cancelAt = 16, 40
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var pixels atomic.Int64
+
+	p := testParameters(64, 64)
+	p.RenderOpts.SubPixelSamples = 1
+	p.RenderOpts.CancelCheckInterval = interval
+	p.RenderOpts.Workers = 1
+	p.ViewPort.Warp = func(z complex128) complex128 {
+		if pixels.Add(1) == cancelAt {
+			cancel()
+		}
+		return z
+	}
+
+	if _, err := mustGenerator(t, p).Generate(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Generate error = %v, want context.Canceled", err)
+	}
+	if n := pixels.Load(); n > cancelAt+interval {
+		t.Errorf("rendered %d pixels, want at most %d after cancelling at %d", n, cancelAt+interval, cancelAt)
+	}
+}
+
+func BenchmarkCancelCheckInterval(b *testing.B) {
+	for _, interval := range []int{1, 64, 4096} {
+		b.Run(fmt.Sprintf("every%d", interval), func(b *testing.B) {
+			p := testParameters(128, 128)
+			p.RenderOpts.SubPixelSamples = 1
+			p.RenderOpts.MaxIterations = 20
+			p.RenderOpts.CancelCheckInterval = interval
+			g := mustGenerator(b, p)
+			b.ResetTimer()
+			for range b.N {
+				if _, err := g.Generate(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestForEachRowReportsErrorsWithFewWorkers(t *testing.T) {
+	p := testParameters(1, 10000)
+	p.RenderOpts.Workers = 2
+	g := mustGenerator(t, p)
+
+	// すべての行がエラーになっても、ワーカー数の大きさのチャネルで詰まらずに最初のエラーを返す
+	errRow := errors.New("row failed")
+	var rows atomic.Int64
+	err := g.forEachRow(func(py int) error {
+		rows.Add(1)
+		return fmt.Errorf("row %d: %w", py, errRow)
+	})
+	if !errors.Is(err, errRow) {
+		t.Errorf("forEachRow error = %v, want %v", err, errRow)
+	}
+	if n := rows.Load(); n != 10000 {
+		t.Errorf("processed %d rows, want all 10000", n)
+	}
+}
+
+func tiltShiftParameters() Parameters {
+	p := testParameters(16, 64)
+	p.RenderOpts.TiltShift.Enabled = true
+	p.RenderOpts.TiltShift.Center = 0.5
+	p.RenderOpts.TiltShift.Height = 0.2
+	p.RenderOpts.TiltShift.Falloff = 0.3
+	p.RenderOpts.TiltShift.MinIterations = 10
+	return p
+}
+
+func TestTiltShiftReducesIterationsAndSamplesAwayFromBand(t *testing.T) {
+	p := tiltShiftParameters()
+	p.RenderOpts.SubPixelSamples = 16
+	p.RenderOpts.Sampling = SamplingCMJ
+	g := mustGenerator(t, p)
+	sw, sh := g.samplingStep()
+
+	limit := func(py int) int {
+		x, y := g.pixelCoord(8, py)
+		return g.maxIterations(complex(x, y))
+	}
+	samples := func(py int) int { return len(g.getSamples(8, py, sw, sh, nil)) }
+
+	center, top, bottom := 32, 0, 63
+	if limit(center) != p.RenderOpts.MaxIterations || samples(center) != 16 {
+		t.Errorf("center row: limit %d, %d samples; want %d, 16", limit(center), samples(center), p.RenderOpts.MaxIterations)
+	}
+	for _, py := range []int{top, bottom} {
+		if limit(py) >= limit(center) || samples(py) >= samples(center) {
+			t.Errorf("row %d: limit %d, %d samples; want fewer than the center", py, limit(py), samples(py))
+		}
+	}
+	// 帯と端の間では段階的に減る
+	if mid := samples(16); mid <= samples(top) || mid >= samples(center) {
+		t.Errorf("row 16 has %d samples, want between %d and %d", mid, samples(top), samples(center))
+	}
+}
+
+func TestTiltShiftCornersStepsFromFourToOne(t *testing.T) {
+	g := mustGenerator(t, tiltShiftParameters())
+	sw, sh := g.samplingStep()
+
+	for py := 0; py < 64; py++ {
+		if n := len(g.getSamples(8, py, sw, sh, nil)); n != 1 && n != 4 {
+			t.Errorf("row %d has %d samples, want 1 or 4 with SamplingCorners", py, n)
+		}
+	}
+	if n := len(g.getSamples(8, 0, sw, sh, nil)); n != 1 {
+		t.Errorf("top row has %d samples, want 1", n)
+	}
+}
+
+// 以前の既定の出力。ピクセルの左上を基準に右下へ寄った4点を取り、sRGB の値のまま平均していた。
+func oldDefaultRender(g *Generator) *image.RGBA {
+	w, h := g.params.Size.Width, g.params.Size.Height
+	vp := g.params.ViewPort
+	sw, sh := g.samplingStep()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px++ {
+			x := float64(px)/float64(w)*(vp.XMax-vp.XMin) + vp.XMin
+			y := float64(py)/float64(h)*(vp.YMax-vp.YMin) + vp.YMin
+			var colors []fcolor
+			for _, d := range []point{{0, 0}, {sw, 0}, {sw, sh}, {0, sh}} {
+				colors = append(colors, g.mandelbrot(complex(x+d.x, y+d.y), nil))
+			}
+			c := averageColors(colors, false)
+			img.SetRGBA(px, py, color.RGBA{R: toUint8(c.r), G: toUint8(c.g), B: toUint8(c.b), A: toUint8(c.a)})
+		}
+	}
+	return img
+}
+
+// 実軸について上下を折り返した画像との差の合計。集合は実軸について対称なので、
+// サンプルがピクセルの中心に揃っていれば 0 に近い。
+func verticalAsymmetry(img *image.RGBA) int {
+	b := img.Bounds()
+	var sum int
+	for y := 0; y < b.Dy()/2; y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c, m := img.RGBAAt(x, y), img.RGBAAt(x, b.Dy()-1-y)
+			sum += int(absDiff(c.R, m.R)) + int(absDiff(c.G, m.G)) + int(absDiff(c.B, m.B))
+		}
+	}
+	return sum
+}
+
+func TestDefaultSamplingIsCenteredAndLinear(t *testing.T) {
+	g := mustGenerator(t, testParameters(64, 64))
+	img, err := g.Generate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := oldDefaultRender(g)
+
+	// 以前の出力は下に半ピクセル分ずれていて上下が対称にならない
+	if newAsym, oldAsym := verticalAsymmetry(img), verticalAsymmetry(old); newAsym*10 > oldAsym {
+		t.Errorf("asymmetry about the real axis: new %d, old %d; want the new output to be centered", newAsym, oldAsym)
+	}
+
+	// 白と黒が半分ずつのピクセルは、線形光で平均すると sRGB の中間 (128) より明るくなる
+	white, black := fcolor{1, 1, 1, 1}, fcolor{a: 1}
+	c := averageColors([]fcolor{white.toLinear(), black.toLinear()}, false)
+	if got := g.encoder().encode(c, 0, 0).R; got < 186 || got > 189 {
+		t.Errorf("half white pixel encodes to %d, want about 188", got)
+	}
+}
+
+func TestExactCoordinatesCenterPixel(t *testing.T) {
+	p := testParameters(101, 7)
+	p.ViewPort.XMin, p.ViewPort.XMax = -1.1, 0.3
+	p.ViewPort.YMin, p.ViewPort.YMax = 0.1, 0.7
+	p.RenderOpts.ExactCoordinates = true
+	g := mustGenerator(t, p)
+
+	midpoint := func(lo, hi float64) float64 {
+		m := new(big.Rat).Add(new(big.Rat).SetFloat64(lo), new(big.Rat).SetFloat64(hi))
+		v, _ := m.Quo(m, big.NewRat(2, 1)).Float64()
+		return v
+	}
+	x, y := g.pixelCoord(50, 3)
+	if want := midpoint(-1.1, 0.3); x != want {
+		t.Errorf("center column maps to %v, want %v", x, want)
+	}
+	if want := midpoint(0.1, 0.7); y != want {
+		t.Errorf("center row maps to %v, want %v", y, want)
+	}
+}
+
+func TestGenerateMaskedSkipsMaskedPixels(t *testing.T) {
+	const w, h = 32, 16
+	// 各ピクセルが何回反復されたかを Warp で数える
+	var mu sync.Mutex
+	counts := make([]int, w*h)
+	p := testParameters(w, h)
+	p.ViewPort.Warp = func(z complex128) complex128 {
+		px := int((real(z) - p.ViewPort.XMin) / (p.ViewPort.XMax - p.ViewPort.XMin) * w)
+		py := int((imag(z) - p.ViewPort.YMin) / (p.ViewPort.YMax - p.ViewPort.YMin) * h)
+		mu.Lock()
+		counts[py*w+px]++
+		mu.Unlock()
+		return z
+	}
+	g := mustGenerator(t, p)
+
+	mask := image.NewAlpha(image.Rect(0, 0, w, h))
+	for py := 0; py < h; py++ {
+		for px := 0; px < w/2; px++ {
+			mask.SetAlpha(px, py, color.Alpha{A: 255})
+		}
+	}
+	fill := color.RGBA{R: 10, G: 20, B: 30, A: 255}
+	img, err := g.GenerateMasked(context.Background(), mask, fill)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px++ {
+			n := counts[py*w+px]
+			if px < w/2 {
+				if n != 0 {
+					t.Errorf("masked pixel (%d, %d) was iterated %d times", px, py, n)
+				}
+				if c := img.RGBAAt(px, py); c != fill {
+					t.Errorf("masked pixel (%d, %d) = %v, want fill %v", px, py, c, fill)
+				}
+			} else if n == 0 {
+				t.Errorf("unmasked pixel (%d, %d) was not iterated", px, py)
+			}
+		}
+	}
+}
+
+func TestPixelScale(t *testing.T) {
+	p := testParameters(200, 50)
+	p.ViewPort.XMin, p.ViewPort.XMax = -1.5, 0.5
+	p.ViewPort.YMin, p.ViewPort.YMax = -0.25, 0.25
+	dx, dy := mustGenerator(t, p).PixelScale()
+	if dx != 2.0/200 || dy != 0.5/50 {
+		t.Errorf("PixelScale() = %v, %v; want %v, %v", dx, dy, 2.0/200, 0.5/50)
+	}
+}
+
+func TestMathOrientationMirrorsVertically(t *testing.T) {
+	p := testParameters(24, 20)
+	p.ViewPort.YMin, p.ViewPort.YMax = -0.3, 1.2
+	screen := mustGenerate(t, p)
+	p.ViewPort.MathOrientation = true
+	flipped := mustGenerate(t, p)
+
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 24; x++ {
+			if a, b := screen.RGBAAt(x, y), flipped.RGBAAt(x, 19-y); a != b {
+				t.Fatalf("pixel (%d, %d) = %v, mirrored pixel = %v", x, y, a, b)
+			}
+		}
+	}
+}
+
+// 周期的な縞を画素間隔に近い周波数でサンプリングしたときに現れるうなり (モアレ) の強さ
+func moireEnergy(t *testing.T, jitter float64) float64 {
+	const w, freq = 200, 0.95 // 1ピクセルあたり 0.95 周期の縞。うなりは 200 ピクセルで 10 周期になる
+	p := testParameters(w, 4)
+	p.ViewPort.XMin, p.ViewPort.XMax = 0, w
+	p.ViewPort.YMin, p.ViewPort.YMax = 0, 4
+	p.RenderOpts.SubPixelSamples = 1
+	p.RenderOpts.PixelJitter = jitter
+	p.RenderOpts.Palette = CyclicGradient{{R: 255, G: 255, B: 255, A: 255}}
+	p.ViewPort.Warp = func(z complex128) complex128 {
+		if math.Sin(2*math.Pi*freq*real(z)) > 0 {
+			return 0 // 内部 (黒)
+		}
+		return 3 // すぐに脱出する (白)
+	}
+	img := mustGenerate(t, p)
+
+	var re, im float64
+	for x := 0; x < w; x++ {
+		var v float64
+		for y := 0; y < 4; y++ {
+			v += float64(img.RGBAAt(x, y).R) / 4
+		}
+		phase := 2 * math.Pi * 10 * float64(x) / w
+		re += v * math.Cos(phase)
+		im += v * math.Sin(phase)
+	}
+	return math.Hypot(re, im)
+}
+
+func TestPixelJitterReducesMoire(t *testing.T) {
+	regular, jittered := moireEnergy(t, 0), moireEnergy(t, 1)
+	if jittered*2 > regular {
+		t.Errorf("energy at the beat frequency: %g with jitter, %g without; want it at least halved", jittered, regular)
+	}
+}
+
+func TestWarpRotationMatchesRotatedImage(t *testing.T) {
+	const n = 48
+	p := testParameters(n, n)
+	plain := mustGenerate(t, p)
+
+	// 恒等変換は Warp なしと同じ
+	p.ViewPort.Warp = func(z complex128) complex128 { return z }
+	if identity := mustGenerate(t, p); !bytes.Equal(identity.Pix, plain.Pix) {
+		t.Error("identity warp changed the image")
+	}
+
+	// i を掛ける (90° 回転) と、回転前の画像の (n-1-py, px) のピクセルと同じ点を反復する。
+	// 丸めの差で境界のピクセルが変わることはあるので、わずかな不一致は許す。
+	p.ViewPort.Warp = func(z complex128) complex128 { return z * 1i }
+	rotated := mustGenerate(t, p)
+	var mismatched int
+	for py := 0; py < n; py++ {
+		for px := 0; px < n; px++ {
+			if _, ok := CompareImages(rotated.SubImage(image.Rect(px, py, px+1, py+1)),
+				plain.SubImage(image.Rect(n-1-py, px, n-py, px+1)), 1); !ok {
+				mismatched++
+			}
+		}
+	}
+	if mismatched > n*n/100 {
+		t.Errorf("%d of %d pixels differ from the rotated image", mismatched, n*n)
+	}
+}
+
+func TestSaveImagesWritesEveryFile(t *testing.T) {
+	dir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	images := make(map[string]*image.RGBA)
+	for i := range 6 {
+		images[filepath.Join(dir, fmt.Sprintf("%d.png", i))] = img
+	}
+	if err := SaveImages(images, 2); err != nil {
+		t.Fatal(err)
+	}
+	for filename := range images {
+		if _, err := os.Stat(filename); err != nil {
+			t.Errorf("file was not written: %v", err)
+		}
+	}
+
+	// 書き込めないファイルのエラーはまとめて返す
+	images[filepath.Join(dir, "missing", "x.png")] = img
+	if err := SaveImages(images, 2); err == nil || !strings.Contains(err.Error(), "x.png") {
+		t.Errorf("SaveImages error = %v, want one naming x.png", err)
+	}
+	if err := SaveImages(images, 0); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("SaveImages with concurrency 0 error = %v, want ErrInvalidParameters", err)
+	}
+}
+
+func TestSaveImagesRespectsConcurrency(t *testing.T) {
+	const limit = 3
+	images := make(map[string]*image.RGBA)
+	for i := range 20 {
+		images[fmt.Sprint(i)] = nil
+	}
+
+	var running, peak atomic.Int64
+	err := saveAll(images, limit, func(*image.RGBA, string) error {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := peak.Load(); p > limit {
+		t.Errorf("%d saves ran at once, want at most %d", p, limit)
+	}
+}
+
+func TestDefaultContrastScalesWithMaxIterations(t *testing.T) {
+	for _, n := range []int{50, 100, 200, 400} {
+		a, b := DefaultContrast(n), DefaultContrast(2*n)
+		if ratio := float64(a) / float64(b); ratio < 1.8 || ratio > 2.2 {
+			t.Errorf("DefaultContrast(%d) = %d, DefaultContrast(%d) = %d; want about half", n, a, 2*n, b)
+		}
+	}
+	// 大きな上限でも 1 を下回らない
+	if c := DefaultContrast(1 << 20); c != 1 {
+		t.Errorf("DefaultContrast(1<<20) = %d, want 1", c)
+	}
+	p := NewDefaultParameters()
+	if p.RenderOpts.Contrast != DefaultContrast(p.RenderOpts.MaxIterations) {
+		t.Errorf("default Contrast = %d, want DefaultContrast(%d)", p.RenderOpts.Contrast, p.RenderOpts.MaxIterations)
+	}
+}
+
+func TestGenerateIntoSubRegion(t *testing.T) {
+	p := testParameters(20, 10)
+	want := mustGenerate(t, p)
+
+	border := color.RGBA{R: 1, G: 2, B: 3, A: 4}
+	dst := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for i := 0; i < len(dst.Pix); i += 4 {
+		copy(dst.Pix[i:], []uint8{border.R, border.G, border.B, border.A})
+	}
+	origin := image.Pt(7, 11)
+	if err := mustGenerator(t, p).GenerateInto(context.Background(), dst, origin); err != nil {
+		t.Fatal(err)
+	}
+
+	region := image.Rectangle{Min: origin, Max: origin.Add(image.Pt(20, 10))}
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			got := dst.RGBAAt(x, y)
+			if image.Pt(x, y).In(region) {
+				if c := want.RGBAAt(x-origin.X, y-origin.Y); got != c {
+					t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, c)
+				}
+			} else if got != border {
+				t.Fatalf("pixel (%d, %d) outside the region changed to %v", x, y, got)
+			}
+		}
+	}
+
+	if err := mustGenerator(t, p).GenerateInto(context.Background(), dst, image.Pt(30, 0)); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("GenerateInto past the edge error = %v, want ErrInvalidParameters", err)
+	}
+}
+
+func TestDegenerateViewport(t *testing.T) {
+	p := testParameters(16, 4)
+	p.ViewPort.YMin, p.ViewPort.YMax = 0.1, 0.1
+
+	// 既定では幅のない軸を名前付きのエラーにする
+	_, err := NewGenerator(p)
+	if !errors.Is(err, ErrInvalidParameters) || !strings.Contains(err.Error(), "Y axis is degenerate") {
+		t.Errorf("strict error = %v, want one naming the Y axis", err)
+	}
+
+	p.ViewPort.AllowDegenerate = true
+	img := mustGenerate(t, p)
+	// すべての行が同じ線を反復するので、どの行も同じになる
+	for y := 1; y < 4; y++ {
+		for x := 0; x < 16; x++ {
+			if img.RGBAAt(x, y) != img.RGBAAt(x, 0) {
+				t.Fatalf("row %d differs from row 0 at x=%d in a line render", y, x)
+			}
+		}
+	}
+
+	// 逆向きの範囲は許さない
+	p.ViewPort.YMin = 0.2
+	if _, err := NewGenerator(p); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("reversed range error = %v, want ErrInvalidParameters", err)
+	}
+}
+
+func TestSaveImageWithCompression(t *testing.T) {
+	img := mustGenerate(t, testParameters(128, 128))
+	dir := t.TempDir()
+
+	sizes := map[png.CompressionLevel]int64{}
+	for _, level := range []png.CompressionLevel{png.BestSpeed, png.BestCompression} {
+		filename := filepath.Join(dir, fmt.Sprintf("level%d.png", level))
+		if err := SaveImageWithCompression(img, filename, level); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if _, ok := CompareImages(decoded, img, 0); !ok {
+			t.Errorf("level %d: decoded image differs from the original", level)
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = info.Size()
+	}
+	if sizes[png.BestCompression] >= sizes[png.BestSpeed] {
+		t.Errorf("BestCompression wrote %d bytes, BestSpeed %d; want a smaller file", sizes[png.BestCompression], sizes[png.BestSpeed])
+	}
+}
+
+func TestFocusRaisesIterationsNearFocus(t *testing.T) {
+	p := testParameters(64, 64)
+	p.RenderOpts.Focus.Enabled = true
+	p.RenderOpts.Focus.X, p.RenderOpts.Focus.Y = -1, 0
+	p.RenderOpts.Focus.Radius = 0.3
+	p.RenderOpts.Focus.MinIterations = 10
+	g, f := mustCompute(t, p)
+
+	if near, far := g.maxIterations(complex(-1, 0)), g.maxIterations(complex(0.25, 1)); near != 200 || far >= near {
+		t.Errorf("iteration limit %d at the focus, %d far away", near, far)
+	}
+
+	// 内部のピクセルは上限まで反復するので、注目点の近くほど反復回数が多い
+	focusX, focusY := int((-1+2)/4.0*64), 32
+	near := f.PixelIterations(focusX, focusY)
+	far := f.PixelIterations(30, 32) // 主カージオイドの中 (-0.09, 0)
+	if near <= far {
+		t.Errorf("pixel near the focus iterated %g times, far interior pixel %g", near, far)
+	}
+}
+
+func TestGenerateWithHash(t *testing.T) {
+	p := testParameters(24, 16)
+	img, hash, err := mustGenerator(t, p).GenerateWithHash(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(img.Pix)
+	if want := hex.EncodeToString(sum[:]); hash != want {
+		t.Errorf("hash = %s, want %s", hash, want)
+	}
+	if !bytes.Equal(img.Pix, mustGenerate(t, p).Pix) {
+		t.Error("GenerateWithHash image differs from Generate")
+	}
+}
+
+func TestPolarMapping(t *testing.T) {
+	p := testParameters(64, 32)
+	cartesian := mustGenerate(t, p)
+	p.ViewPort.Polar.Enabled = true
+	p.ViewPort.Polar.X, p.ViewPort.Polar.Y = -0.75, 0
+	p.ViewPort.Polar.RMin, p.ViewPort.Polar.RMax = 0.05, 2
+	g := mustGenerator(t, p)
+	polar := mustGenerate(t, p)
+
+	if bytes.Equal(polar.Pix, cartesian.Pix) {
+		t.Fatal("polar render is identical to the cartesian one")
+	}
+
+	// 左端は角度 0、上端は半径 RMin
+	vp := p.ViewPort
+	if z := g.mapPoint(vp.XMin, vp.YMin); cmplx.Abs(z-complex(-0.7, 0)) > 1e-12 {
+		t.Errorf("top-left corner maps to %v, want (-0.7, 0)", z)
+	}
+	// 中心が実軸上にあるので、角度 θ と -θ は同じ色になり、左右が対称になる
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if a, b := polar.RGBAAt(x, y), polar.RGBAAt(63-x, y); a != b {
+				t.Fatalf("polar pixel (%d, %d) = %v, mirrored = %v", x, y, a, b)
+			}
+		}
+	}
+}
+
+func TestColorAtMatchesRender(t *testing.T) {
+	p := testParameters(32, 24)
+	p.RenderOpts.SubPixelSamples = 1
+	p.RenderOpts.Dither = true
+	g := mustGenerator(t, p)
+	img, err := g.Generate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for py := 0; py < p.Size.Height; py++ {
+		for px := 0; px < p.Size.Width; px++ {
+			x, y := g.pixelCoord(px, py)
+			got := color.RGBAModel.Convert(g.ColorAt(complex(x, y))).(color.RGBA)
+			// 画像にはディザがかかっているので1段の違いを許す
+			want := img.RGBAAt(px, py)
+			for _, d := range []uint8{absDiff(got.R, want.R), absDiff(got.G, want.G), absDiff(got.B, want.B), absDiff(got.A, want.A)} {
+				if d > 1 {
+					t.Fatalf("ColorAt at the centre of (%d, %d) = %v, pixel = %v", px, py, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestColorAtIgnoresPolar(t *testing.T) {
+	p := testParameters(32, 24)
+	plain := mustGenerator(t, p)
+	p.ViewPort.Polar.Enabled = true
+	p.ViewPort.Polar.RMin, p.ViewPort.Polar.RMax = 0.1, 1
+	polar := mustGenerator(t, p)
+
+	for _, z := range []complex128{-0.5, 0.3 + 0.5i, -1.7 + 0.01i} {
+		if a, b := plain.ColorAt(z), polar.ColorAt(z); a != b {
+			t.Errorf("ColorAt(%v) = %v with Polar, %v without", z, b, a)
+		}
+	}
+}
+
+func TestGenerateSupersampledCountsSamples(t *testing.T) {
+	const w, h = 24, 12
+	// 各ピクセルのサンプル数を Warp で数える
+	var mu sync.Mutex
+	counts := make([]int, w*h)
+	p := testParameters(w, h)
+	p.RenderOpts.Sampling = SamplingCMJ
+	p.RenderOpts.SubPixelSamples = 9
+	p.ViewPort.Warp = func(z complex128) complex128 {
+		px := int((real(z) - p.ViewPort.XMin) / (p.ViewPort.XMax - p.ViewPort.XMin) * w)
+		py := int((imag(z) - p.ViewPort.YMin) / (p.ViewPort.YMax - p.ViewPort.YMin) * h)
+		mu.Lock()
+		counts[py*w+px]++
+		mu.Unlock()
+		return z
+	}
+	g := mustGenerator(t, p)
+
+	mask := image.NewAlpha(image.Rect(0, 0, w, h))
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px += 3 {
+			mask.SetAlpha(px, py, color.Alpha{A: 255})
+		}
+	}
+	if _, err := g.GenerateSupersampled(context.Background(), mask); err != nil {
+		t.Fatal(err)
+	}
+
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px++ {
+			want := 1
+			if px%3 == 0 {
+				want = 9
+			}
+			if n := counts[py*w+px]; n != want {
+				t.Errorf("pixel (%d, %d) got %d samples, want %d", px, py, n, want)
+			}
+		}
+	}
+}
+
+func TestEncodePNGMatchesSaveImage(t *testing.T) {
+	img := mustGenerate(t, testParameters(32, 24))
+	data, err := EncodePNG(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxDiff, ok := CompareImages(img, decoded, 0); !ok {
+		t.Errorf("decoded PNG differs from the image by %d", maxDiff)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.png")
+	if err := SaveImage(img, name); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, saved) {
+		t.Error("EncodePNG and SaveImage produced different bytes")
+	}
+}
+
+func TestEncodeJPEG(t *testing.T) {
+	img := mustGenerate(t, testParameters(32, 24))
+	data, err := EncodeJPEG(img, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Errorf("decoded JPEG bounds = %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"cmp"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+)
+
+// Palette は 0..1 の位置を色に対応付ける。
+// 脱出したサンプルは Contrast*n/256 の位置で参照されるため、
+// 1 を超える位置の扱い (循環・クランプ) は実装側で決める。
+type Palette interface {
+	Color(t float64) color.Color
+}
+
+// CyclicGradient は色を等間隔に並べ、隣り合う色を線形補間しながら周期的に繰り返すパレット。
+// 位置 i/len の色は i 番目の色そのものになり、最後の色は最初の色へとつながる。
+type CyclicGradient []color.RGBA
+
+func (p CyclicGradient) Color(t float64) color.Color {
+	if len(p) == 0 {
+		return color.Black
+	}
+	t -= math.Floor(t)
+	pos := t * float64(len(p))
+	i := int(pos) % len(p)
+	f := pos - math.Floor(pos)
+	return lerpRGBA(p[i], p[(i+1)%len(p)], f)
+}
+
+// PaletteFromImage は img の中央の行から等間隔に n 色を取り出し、循環するグラデーションを作る。
+func PaletteFromImage(img image.Image, n int) Palette {
+	n = max(n, 1)
+	b := img.Bounds()
+	y := b.Min.Y + b.Dy()/2
+
+	p := make(CyclicGradient, n)
+	for i := range p {
+		x := b.Min.X + int((float64(i)+0.5)*float64(b.Dx())/float64(n))
+		p[i] = color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	}
+	return p
+}
+
+// 2色を t (0..1) の割合で線形補間する
+func lerpRGBA(a, b color.RGBA, t float64) color.RGBA {
+	l := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*t + 0.5)
+	}
+	return color.RGBA{R: l(a.R, b.R), G: l(a.G, b.G), B: l(a.B, b.B), A: l(a.A, b.A)}
+}
+
+// LerpPalette は各位置で a と b の色を t (0..1) の割合で混ぜたパレットを返す。
+// t を少しずつ変えて Colorize し直せば、反復をやり直さずにパレットが移り変わるアニメーションを作れる。
+func LerpPalette(a, b Palette, t float64) Palette {
+	return lerpPalette{a: a, b: b, t: math.Max(0, math.Min(t, 1))}
+}
+
+type lerpPalette struct {
+	a, b Palette
+	t    float64
+}
+
+func (p lerpPalette) Color(t float64) color.Color {
+	ca := color.RGBAModel.Convert(p.a.Color(t)).(color.RGBA)
+	cb := color.RGBAModel.Convert(p.b.Color(t)).(color.RGBA)
+	return lerpRGBA(ca, cb, p.t)
+}
+
+// ColorSpace はグラデーションを補間する色空間を表す
+type ColorSpace int
+
+const (
+	// sRGB の値のまま補間する
+	ColorSpaceSRGB ColorSpace = iota
+	// 線形光に変換してから補間する。明るさの変化が物理的に自然になる。
+	ColorSpaceLinear
+)
+
+// ColorStop はグラデーション上の位置 (0..1) とその位置の色
+type ColorStop struct {
+	Pos   float64
+	Color color.RGBA
+}
+
+// GradientPalette は色の区切り (ストップ) の間を線形補間するパレット
+type GradientPalette struct {
+	// Pos の昇順に並んだストップ
+	Stops []ColorStop
+	// true の場合は位置を 1 周期で繰り返し、最後のストップから最初のストップへつなげる。
+	// false の場合は 0..1 にクランプする。
+	Wrap  bool
+	Space ColorSpace
+}
+
+// NewGradientPalette はストップを位置順に並べたグラデーションパレットを作る
+func NewGradientPalette(stops ...ColorStop) *GradientPalette {
+	sorted := slices.Clone(stops)
+	slices.SortStableFunc(sorted, func(a, b ColorStop) int {
+		return cmp.Compare(a.Pos, b.Pos)
+	})
+	return &GradientPalette{Stops: sorted}
+}
+
+func (p *GradientPalette) Color(t float64) color.Color {
+	if len(p.Stops) == 0 {
+		return color.Black
+	}
+	first, last := p.Stops[0], p.Stops[len(p.Stops)-1]
+
+	if p.Wrap {
+		t -= math.Floor(t)
+		// 最後のストップを越えた区間は次の周期の最初のストップへ補間する
+		switch {
+		case t < first.Pos:
+			return p.interpolate(last, first, (t+1-last.Pos)/(first.Pos+1-last.Pos))
+		case t > last.Pos:
+			return p.interpolate(last, first, (t-last.Pos)/(first.Pos+1-last.Pos))
+		}
+	}
+
+	t = math.Max(0, math.Min(t, 1))
+	if t <= first.Pos {
+		return first.Color
+	}
+	for i := 1; i < len(p.Stops); i++ {
+		a, b := p.Stops[i-1], p.Stops[i]
+		if t <= b.Pos {
+			if b.Pos == a.Pos {
+				return b.Color
+			}
+			return p.interpolate(a, b, (t-a.Pos)/(b.Pos-a.Pos))
+		}
+	}
+	return last.Color
+}
+
+// 2つのストップの色を Space の色空間で補間する
+func (p *GradientPalette) interpolate(a, b ColorStop, t float64) color.RGBA {
+	if p.Space != ColorSpaceLinear {
+		return lerpRGBA(a.Color, b.Color, t)
+	}
+	l := func(x, y uint8) uint8 {
+		lx, ly := srgbToLinear(float64(x)/255), srgbToLinear(float64(y)/255)
+		return toUint8(linearToSRGB(lx + (ly-lx)*t))
+	}
+	return color.RGBA{
+		R: l(a.Color.R, b.Color.R),
+		G: l(a.Color.G, b.Color.G),
+		B: l(a.Color.B, b.Color.B),
+		A: lerpRGBA(a.Color, b.Color, t).A,
+	}
+}
+
+// RenderPaletteStrip は位置 0..1 を左端から右端に対応させた横長のグラデーション画像を返す。
+// パレットをフラクタルの描画なしで確認・比較するのに使う。
+func RenderPaletteStrip(p Palette, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, max(width, 0), max(height, 0)))
+	for x := 0; x < width; x++ {
+		t := 0.0
+		if width > 1 {
+			t = float64(x) / float64(width-1)
+		}
+		c := color.RGBAModel.Convert(p.Color(t)).(color.RGBA)
+		for y := 0; y < height; y++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
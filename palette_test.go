@@ -0,0 +1,117 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPaletteFromImage(t *testing.T) {
+	// 中央の行を 8 ピクセルずつの色の帯にした参照画像
+	colors := []color.RGBA{
+		{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}, {R: 200, G: 100, B: 50, A: 255},
+	}
+	img := image.NewRGBA(image.Rect(10, 20, 42, 23))
+	for x := 0; x < 32; x++ {
+		img.SetRGBA(10+x, 21, colors[x/8])
+	}
+
+	p := PaletteFromImage(img, len(colors))
+	for i, want := range colors {
+		if got := color.RGBAModel.Convert(p.Color(float64(i) / float64(len(colors)))); got != want {
+			t.Errorf("palette color %d = %v, want %v", i, got, want)
+		}
+		// 周期的なので 1 ずれた位置でも同じ色になる
+		if got := color.RGBAModel.Convert(p.Color(1 + float64(i)/float64(len(colors)))); got != want {
+			t.Errorf("palette color %d one cycle later = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestPaletteOptionColorsExterior(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	p := testParameters(32, 32)
+	p.RenderOpts.Palette = CyclicGradient{red}
+	img := mustGenerate(t, p)
+
+	// 左上の角は外部なので、単色のパレットの色になる
+	if c := img.RGBAAt(0, 0); c != red {
+		t.Errorf("exterior pixel = %v, want %v", c, red)
+	}
+}
+
+func TestGradientPaletteMidpoint(t *testing.T) {
+	p := NewGradientPalette(
+		ColorStop{Pos: 1, Color: color.RGBA{R: 255, G: 255, B: 255, A: 255}},
+		ColorStop{Pos: 0, Color: color.RGBA{A: 255}},
+	)
+	if got := color.RGBAModel.Convert(p.Color(0.5)).(color.RGBA); got != (color.RGBA{R: 128, G: 128, B: 128, A: 255}) {
+		t.Errorf("sRGB midpoint = %v, want gray 128", got)
+	}
+
+	// 線形光の中間 (0.5) は sRGB では 188 になる
+	p.Space = ColorSpaceLinear
+	if got := color.RGBAModel.Convert(p.Color(0.5)).(color.RGBA); got.R != 188 || got.R != got.G || got.G != got.B {
+		t.Errorf("linear midpoint = %v, want gray 188", got)
+	}
+}
+
+func TestGradientPaletteWrapAndClamp(t *testing.T) {
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	p := NewGradientPalette(ColorStop{Pos: 0.25, Color: red}, ColorStop{Pos: 0.75, Color: blue})
+
+	// クランプでは範囲外は端の色になる
+	if got := p.Color(1.2); got != blue {
+		t.Errorf("clamped color at 1.2 = %v, want %v", got, blue)
+	}
+	if got := p.Color(0.1); got != red {
+		t.Errorf("clamped color at 0.1 = %v, want %v", got, red)
+	}
+
+	// 繰り返しでは最後のストップから次の周期の最初のストップへつながる
+	p.Wrap = true
+	if got := p.Color(1.25); got != red {
+		t.Errorf("wrapped color at 1.25 = %v, want %v", got, red)
+	}
+	if got := color.RGBAModel.Convert(p.Color(0)).(color.RGBA); got != (color.RGBA{R: 128, B: 128, A: 255}) {
+		t.Errorf("wrapped color at 0 = %v, want halfway between blue and red", got)
+	}
+}
+
+func TestRenderPaletteStrip(t *testing.T) {
+	black, white := color.RGBA{A: 255}, color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	p := NewGradientPalette(ColorStop{Pos: 0, Color: black}, ColorStop{Pos: 1, Color: white})
+	img := RenderPaletteStrip(p, 64, 5)
+
+	if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 5 {
+		t.Fatalf("strip is %v, want 64x5", b)
+	}
+	for y := 0; y < 5; y++ {
+		if c := img.RGBAAt(0, y); c != black {
+			t.Errorf("left column at y=%d = %v, want %v", y, c, black)
+		}
+		if c := img.RGBAAt(63, y); c != white {
+			t.Errorf("right column at y=%d = %v, want %v", y, c, white)
+		}
+	}
+	if c := img.RGBAAt(32, 2); c.R <= 0 || c.R >= 255 {
+		t.Errorf("middle of the strip = %v, want between the endpoints", c)
+	}
+}
+
+func TestLerpPalette(t *testing.T) {
+	red, blue := CyclicGradient{{R: 255, A: 255}}, CyclicGradient{{B: 255, A: 255}}
+	for _, tc := range []struct {
+		t    float64
+		want color.RGBA
+	}{
+		{0, color.RGBA{R: 255, A: 255}},
+		{1, color.RGBA{B: 255, A: 255}},
+		{0.5, color.RGBA{R: 128, B: 128, A: 255}},
+		{2, color.RGBA{B: 255, A: 255}},
+	} {
+		if got := color.RGBAModel.Convert(LerpPalette(red, blue, tc.t).Color(0.3)); got != tc.want {
+			t.Errorf("LerpPalette(t=%g) = %v, want %v", tc.t, got, tc.want)
+		}
+	}
+}
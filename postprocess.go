@@ -0,0 +1,183 @@
+package main
+
+import "math"
+
+// applyBloom はしきい値を超える明るいピクセルを抽出し、ぼかして加算する。
+// img は線形光の値を保持している。
+func applyBloom(img *floatImage, threshold, intensity, radius float64) {
+	w, h := img.w, img.h
+	bright := make([][3]float64, w*h)
+
+	for i, p := range img.pix {
+		c := [3]float64{p.r, p.g, p.b}
+
+		// しきい値を超えた分だけを抽出する
+		lum := 0.2126*c[0] + 0.7152*c[1] + 0.0722*c[2]
+		if lum > threshold {
+			k := (lum - threshold) / lum
+			bright[i] = [3]float64{c[0] * k, c[1] * k, c[2] * k}
+		}
+	}
+
+	blurred := gaussianBlur(bright, w, h, radius)
+
+	for i := range img.pix {
+		img.pix[i].r += intensity * blurred[i][0]
+		img.pix[i].g += intensity * blurred[i][1]
+		img.pix[i].b += intensity * blurred[i][2]
+	}
+}
+
+// applyEllipseCrop は画像に内接する楕円の外を透明にする。
+// 縁からの距離が ±feather/2 ピクセルの範囲でアルファを滑らかに変える。
+func applyEllipseCrop(img *floatImage, feather float64) {
+	a, b := float64(img.w)/2, float64(img.h)/2
+	for y := 0; y < img.h; y++ {
+		for x := 0; x < img.w; x++ {
+			dx, dy := float64(x)+0.5-a, float64(y)+0.5-b
+			rho := math.Hypot(dx/a, dy/b)
+			var alpha float64
+			if rho == 0 {
+				alpha = 1
+			} else {
+				// 楕円の縁までの距離を、rho の勾配で割った1次の近似で求める
+				grad := math.Hypot(dx/(a*a), dy/(b*b)) / rho
+				alpha = math.Max(0, math.Min(0.5-(rho-1)/grad/feather, 1))
+			}
+			c := img.at(x, y)
+			img.set(x, y, fcolor{r: c.r * alpha, g: c.g * alpha, b: c.b * alpha, a: c.a * alpha})
+		}
+	}
+}
+
+// 分離可能なガウスぼかしを水平・垂直の順にかける
+func gaussianBlur(src [][3]float64, w, h int, sigma float64) [][3]float64 {
+	r := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*r+1)
+	var sum float64
+	for i := -r; i <= r; i++ {
+		kernel[i+r] = math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		sum += kernel[i+r]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	// 端はクランプして扱う
+	clamp := func(v, n int) int {
+		return max(0, min(v, n-1))
+	}
+
+	tmp := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var acc [3]float64
+			for k := -r; k <= r; k++ {
+				s := src[y*w+clamp(x+k, w)]
+				for ch := 0; ch < 3; ch++ {
+					acc[ch] += s[ch] * kernel[k+r]
+				}
+			}
+			tmp[y*w+x] = acc
+		}
+	}
+
+	dst := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var acc [3]float64
+			for k := -r; k <= r; k++ {
+				s := tmp[clamp(y+k, h)*w+x]
+				for ch := 0; ch < 3; ch++ {
+					acc[ch] += s[ch] * kernel[k+r]
+				}
+			}
+			dst[y*w+x] = acc
+		}
+	}
+	return dst
+}
+
+// applyMLAA は形態的アンチエイリアスを適用する。
+// 隣接ピクセルの輝度差からエッジを検出し、エッジの連なりの両端の形 (L・U・Z 字) から
+// 本来の境界線を推定して、その線が横切る面積に応じて隣のピクセルと混色する。
+func applyMLAA(img *floatImage, threshold float64) {
+	w, h := img.w, img.h
+	src := make([]fcolor, len(img.pix))
+	copy(src, img.pix)
+
+	// 水平方向のエッジと、縦横を入れ替えた垂直方向のエッジを処理する
+	blendEdges(src, img.pix, w, h, threshold, func(x, y int) int { return y*w + x })
+	blendEdges(src, img.pix, h, w, threshold, func(x, y int) int { return x*w + y })
+}
+
+// blendEdges は行 y と y+1 の間にある水平エッジを処理する。
+// idx は (x, y) をバッファの添字に変換し、縦横を入れ替えて同じ処理を使い回せるようにする。
+func blendEdges(src, dst []fcolor, w, h int, threshold float64, idx func(x, y int) int) {
+	// 混色は線形光で行うが、エッジの判定は見た目に近い sRGB の輝度で比べる
+	luma := func(c fcolor) float64 {
+		return linearToSRGB(0.2126*c.r + 0.7152*c.g + 0.0722*c.b)
+	}
+	edge := func(i, j int) bool {
+		return math.Abs(luma(src[i])-luma(src[j])) > threshold
+	}
+	// (x-1, y) と (x, y) の間の垂直エッジ
+	vedge := func(x, y int) bool {
+		return x > 0 && x < w && edge(idx(x-1, y), idx(x, y))
+	}
+
+	for y := 0; y+1 < h; y++ {
+		for x := 0; x < w; {
+			if !edge(idx(x, y), idx(x, y+1)) {
+				x++
+				continue
+			}
+			x0 := x
+			for x < w && edge(idx(x, y), idx(x, y+1)) {
+				x++
+			}
+			x1 := x
+
+			// 両端の垂直エッジが上下どちらの行にあるかで境界線の端の高さが決まる
+			endHeight := func(ex int) float64 {
+				up, down := vedge(ex, y), vedge(ex, y+1)
+				switch {
+				case up && !down:
+					return 0.5
+				case down && !up:
+					return -0.5
+				}
+				return 0
+			}
+			hl, hr := endHeight(x0), endHeight(x1)
+
+			length := float64(x1 - x0)
+			for px := x0; px < x1; px++ {
+				t := (float64(px-x0) + 0.5) / length
+				var hgt float64
+				if t < 0.5 {
+					hgt = hl * (1 - 2*t)
+				} else {
+					hgt = hr * (2*t - 1)
+				}
+				upper, lower := idx(px, y), idx(px, y+1)
+				switch {
+				case hgt > 0:
+					dst[upper] = mix(dst[upper], src[lower], hgt)
+				case hgt < 0:
+					dst[lower] = mix(dst[lower], src[upper], -hgt)
+				}
+			}
+		}
+	}
+}
+
+// c を target に向かって weight だけ混ぜる
+func mix(c, target fcolor, weight float64) fcolor {
+	return fcolor{
+		r: c.r + (target.r-c.r)*weight,
+		g: c.g + (target.g-c.g)*weight,
+		b: c.b + (target.b-c.b)*weight,
+		a: c.a + (target.a-c.a)*weight,
+	}
+}
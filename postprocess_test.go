@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBloomBrightensAroundBrightPixels(t *testing.T) {
+	img := newFloatImage(21, 21)
+	for i := range img.pix {
+		img.pix[i] = fcolor{a: 1}
+	}
+	img.set(10, 10, fcolor{1, 1, 1, 1})
+	applyBloom(img, 0.5, 1, 1.5)
+
+	if c := img.at(11, 10); c.r <= 0 {
+		t.Errorf("neighbor of the bright pixel = %v, want brighter than black", c)
+	}
+	if near, far := img.at(11, 10).r, img.at(13, 10).r; near <= far {
+		t.Errorf("bloom at distance 1 = %g, at distance 3 = %g; want it to fall off", near, far)
+	}
+	if c := img.at(0, 0); c.r > 1e-6 {
+		t.Errorf("far corner = %v, want unchanged", c)
+	}
+}
+
+func TestBloomIncreasesBrightness(t *testing.T) {
+	p := testParameters(32, 32)
+	plain := mustGenerate(t, p)
+	p.PostProcess.Bloom.Enabled = true
+	p.PostProcess.Bloom.Threshold = 0.2
+	p.PostProcess.Bloom.Intensity = 1
+	p.PostProcess.Bloom.Radius = 2
+	bloomed := mustGenerate(t, p)
+
+	var sumPlain, sumBloom int
+	for i, v := range plain.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		if bloomed.Pix[i] < v {
+			t.Fatalf("byte %d darkened from %d to %d", i, v, bloomed.Pix[i])
+		}
+		sumPlain += int(v)
+		sumBloom += int(bloomed.Pix[i])
+	}
+	if sumBloom <= sumPlain {
+		t.Errorf("total brightness %d with bloom, %d without; want an increase", sumBloom, sumPlain)
+	}
+}
+
+func cropParameters() Parameters {
+	p := testParameters(48, 32)
+	p.PostProcess.Crop.Enabled = true
+	p.PostProcess.Crop.Feather = 3
+	return p
+}
+
+func TestEllipseCrop(t *testing.T) {
+	img := mustGenerate(t, cropParameters())
+
+	if a := img.RGBAAt(0, 0).A; a != 0 {
+		t.Errorf("corner alpha = %d, want 0", a)
+	}
+	if a := img.RGBAAt(24, 16).A; a != 255 {
+		t.Errorf("center alpha = %d, want 255", a)
+	}
+	// 縁を横切る中央の行にはアルファが中間のピクセルがある
+	var partial int
+	for x := 0; x < 24; x++ {
+		if a := img.RGBAAt(x, 16).A; a > 0 && a < 255 {
+			partial++
+		}
+	}
+	if partial == 0 {
+		t.Error("no pixels with intermediate alpha along the edge")
+	}
+}
+
+func TestCropAfterBloomIsPremultiplied(t *testing.T) {
+	p := cropParameters()
+	p.PostProcess.Bloom.Enabled = true
+	p.PostProcess.Bloom.Threshold = 0.1
+	p.PostProcess.Bloom.Intensity = 3
+	p.PostProcess.Bloom.Radius = 2
+	p.RenderOpts.Dither = true
+	img := mustGenerate(t, p)
+
+	for y := 0; y < p.Size.Height; y++ {
+		for x := 0; x < p.Size.Width; x++ {
+			if c := img.RGBAAt(x, y); c.R > c.A || c.G > c.A || c.B > c.A {
+				t.Fatalf("pixel (%d, %d) = %v has a channel above alpha", x, y, c)
+			}
+		}
+	}
+}
+
+func TestEncodeClampsToAlpha(t *testing.T) {
+	// ブルームを足した後に切り抜いたような、色がアルファを超えたピクセル
+	c := encoder{}.encode(fcolor{r: 0.9, g: 0.3, b: 0.1, a: 0.5}, 0, 0)
+	if c.A != 128 {
+		t.Errorf("alpha = %d, want 128", c.A)
+	}
+	// 切り詰めた値は 1 になるので、丸めの差を除いてアルファと等しい
+	if c.R+1 < c.A {
+		t.Errorf("red = %d, want it clamped to alpha %d", c.R, c.A)
+	}
+	if c.G > c.A || c.B > c.A {
+		t.Errorf("%v has a channel above alpha", c)
+	}
+}
+
+func TestMLAASmoothsEdgesAndKeepsFlatRegions(t *testing.T) {
+	const w, h = 48, 16
+	// 緩やかな傾きの直線より上が白
+	inside := func(x, y float64) bool { return y < 4+x/6 }
+	coverage := func(px, py int) float64 {
+		const n = 16
+		var c float64
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if inside(float64(px)+(float64(i)+0.5)/n, float64(py)+(float64(j)+0.5)/n) {
+					c++
+				}
+			}
+		}
+		return c / (n * n)
+	}
+
+	raw := newFloatImage(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if inside(float64(x)+0.5, float64(y)+0.5) {
+				raw.set(x, y, fcolor{1, 1, 1, 1})
+			} else {
+				raw.set(x, y, fcolor{a: 1})
+			}
+		}
+	}
+	img := newFloatImage(w, h)
+	copy(img.pix, raw.pix)
+	applyMLAA(img, 0.1)
+
+	var rawErr, mlaaErr float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			want := coverage(x, y)
+			rawErr += math.Abs(raw.at(x, y).r - want)
+			mlaaErr += math.Abs(img.at(x, y).r - want)
+			if want == 0 || want == 1 {
+				// 境界から離れた平らな領域は変わらない
+				if d := math.Abs(float64(y) + 0.5 - (4 + (float64(x)+0.5)/6)); d > 2 && img.at(x, y) != raw.at(x, y) {
+					t.Errorf("flat pixel (%d, %d) changed from %v to %v", x, y, raw.at(x, y), img.at(x, y))
+				}
+			}
+		}
+	}
+	if mlaaErr >= rawErr {
+		t.Errorf("coverage error %g after MLAA, %g before; want smoother edges", mlaaErr, rawErr)
+	}
+}
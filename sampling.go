@@ -0,0 +1,264 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// SamplingStrategy はピクセル内のサンプリングポイントの配置方法を表す
+type SamplingStrategy int
+
+const (
+	// ピクセルを 2×2 に分けた各区画の中心 (ピクセル中心から縦横に ±1/4 ピクセル) をサンプリングする。
+	// SubPixelSamples が 1 の場合はピクセル中心の1点だけをサンプリングする。
+	SamplingCorners SamplingStrategy = iota
+	// Correlated Multi-Jittered サンプリング。SubPixelSamples 個の点をピクセル全体に配置する。
+	// 配置はピクセルごとのハッシュで変わり、Seed が同じなら再現できる。
+	SamplingCMJ
+	// 基底 2, 3 の Halton 列の先頭 SubPixelSamples 点を使う。どの点数で打ち切っても偏りが少ない。
+	// ピクセルごとに配置を巡回的にずらし (Cranley-Patterson 回転)、Seed が同じなら再現できる。
+	SamplingHalton
+	// 黄金角で回るらせん (Vogel の配置) に SubPixelSamples 点を並べる。
+	// 点はピクセルに内接する円の中に均等に広がり、格子と違って点数が平方数でなくてもよい。
+	// らせんの向きはピクセルごとに変わり、Seed が同じなら再現できる。
+	SamplingVogel
+	// Halton 列の配置を、RenderOpts.BlueNoise のテクスチャから読んだ量だけピクセルごとに巡回的にずらす。
+	// 隣り合うピクセルのずれが青色雑音になるので、少ないサンプル数でも雑音が目立ちにくい。
+	// テクスチャは画像よりも小さければ繰り返して使う。
+	SamplingBlueNoise
+)
+
+// RandomSource は確率的なサンプリングが使う乱数源。
+// Float64 は呼ばれるたびに [0, 1) の値を返す。
+type RandomSource interface {
+	Float64() float64
+}
+
+// ピクセルのハッシュ値から擬似乱数を順に作る乱数源
+type hashSource struct {
+	hash uint32
+	i    uint32
+}
+
+func (s *hashSource) Float64() float64 {
+	v := randFloat(s.i, s.hash)
+	s.i++
+	return v
+}
+
+// ピクセル (px, py) の乱数源を返す
+func (g *Generator) randomSource(px, py int) RandomSource {
+	if random := g.params.RenderOpts.Random; random != nil {
+		return random(px, py)
+	}
+	return &hashSource{hash: pixelHash(px, py, g.params.RenderOpts.Seed)}
+}
+
+// 1ピクセルあたりのサンプル数を返す
+func (g *Generator) samplesPerPixel() int {
+	if g.params.RenderOpts.AnalyticAA {
+		return 1
+	}
+	if g.params.RenderOpts.Sampling == SamplingCorners {
+		if g.params.RenderOpts.SubPixelSamples == 1 {
+			return 1
+		}
+		return 4
+	}
+	return g.params.RenderOpts.SubPixelSamples
+}
+
+// ピクセル (px, py) 内のサンプリングポイントを返す。n は SubPixelSamples の代わりに使う点数。
+func (g *Generator) samplePoints(px, py, n int, samplingWidth, samplingHeight float64) []point {
+	x, y := g.pixelCoord(px, py)
+	var rnd RandomSource
+	if g.params.RenderOpts.PixelJitter > 0 || g.params.RenderOpts.Sampling != SamplingCorners {
+		rnd = g.randomSource(px, py)
+	}
+	if j := g.params.RenderOpts.PixelJitter; j > 0 {
+		// サンプルの配置はそのままに、ピクセル全体を ±j/2 ピクセルの範囲でずらす
+		x += (rnd.Float64() - 0.5) * j * 2 * samplingWidth
+		y += (rnd.Float64() - 0.5) * j * 2 * samplingHeight
+	}
+
+	var points []point
+	if g.params.RenderOpts.AnalyticAA {
+		// 被覆率は距離推定から求めるので、ピクセル中心の1点だけをサンプリングする
+		points = []point{{x, y}}
+	} else {
+		points = g.strategyPoints(px, py, n, rnd, x, y, samplingWidth, samplingHeight)
+	}
+
+	if g.params.ViewPort.Polar.Enabled || g.params.ViewPort.Warp != nil {
+		for i, p := range points {
+			z := g.mapPoint(p.x, p.y)
+			points[i] = point{real(z), imag(z)}
+		}
+	}
+	return points
+}
+
+// Sampling の配置方法に従って、ピクセル中心 (x, y) のまわりの n 点のサンプリングポイントを返す。
+// SamplingCorners では n が 1 なら1点、それ以外は4点になる。それ以外の配置では rnd から乱数を取る。
+func (g *Generator) strategyPoints(px, py, n int, rnd RandomSource, x, y, samplingWidth, samplingHeight float64) []point {
+	// 単位正方形内の配置を求め、ピクセル全体に広げる
+	var offsets []point
+	switch g.params.RenderOpts.Sampling {
+	case SamplingCMJ:
+		offsets = cmjOffsets(n, rnd)
+	case SamplingHalton:
+		offsets = haltonOffsets(n, point{rnd.Float64(), rnd.Float64()})
+	case SamplingVogel:
+		offsets = vogelOffsets(n, 2*math.Pi*rnd.Float64())
+	case SamplingBlueNoise:
+		offsets = haltonOffsets(n, blueNoiseShift(g.params.RenderOpts.BlueNoise, px, py))
+	default:
+		if n == 1 {
+			return []point{{x, y}}
+		}
+		// 中心から縦横に 1/4 ピクセルずつずらした4点
+		x0, y0 := x-samplingWidth/2, y-samplingHeight/2
+		return []point{
+			{x0, y0},
+			{x0 + samplingWidth, y0},
+			{x0 + samplingWidth, y0 + samplingHeight},
+			{x0, y0 + samplingHeight},
+		}
+	}
+
+	// samplingWidth, samplingHeight は半ピクセルなので、中心から引くとピクセルの左上になり、
+	// その2倍がピクセル全体になる
+	x0, y0 := x-samplingWidth, y-samplingHeight
+	w, h := 2*samplingWidth, 2*samplingHeight
+	points := make([]point, len(offsets))
+	for i, o := range offsets {
+		points[i] = point{x0 + o.x*w, y0 + o.y*h}
+	}
+	return points
+}
+
+// 青色雑音のテクスチャの (px, py) の位置 (繰り返して敷き詰める) の赤と緑から 0..1 のずれを読む
+func blueNoiseShift(tex image.Image, px, py int) point {
+	b := tex.Bounds()
+	tx := b.Min.X + ((px%b.Dx())+b.Dx())%b.Dx()
+	ty := b.Min.Y + ((py%b.Dy())+b.Dy())%b.Dy()
+	c := color.RGBAModel.Convert(tex.At(tx, ty)).(color.RGBA)
+	return point{(float64(c.R) + 0.5) / 256, (float64(c.G) + 0.5) / 256}
+}
+
+// ピクセル座標とシードから 32bit のハッシュ値を作る
+func pixelHash(px, py int, seed uint64) uint32 {
+	h := seed ^ uint64(uint32(px)) ^ uint64(uint32(py))<<32
+	// splitmix64 の最終段
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return uint32(h ^ h>>32)
+}
+
+// cmjOffsets は Kensler の Correlated Multi-Jittered サンプリングで
+// 単位正方形内に n 個の点を配置する。並べ替えのパターンとセル内のずれを rnd から取る。
+// rnd が常に 0.5 を返す場合、各点はそれぞれのセルの中心に置かれる。
+func cmjOffsets(n int, rnd RandomSource) []point {
+	m := max(1, int(math.Sqrt(float64(n))))
+	rows := (n + m - 1) / m
+	pattern := uint32(rnd.Float64() * (1 << 32))
+
+	offsets := make([]point, n)
+	for s := 0; s < n; s++ {
+		sx := permute(uint32(s%m), uint32(m), pattern*0xa511e9b3)
+		sy := permute(uint32(s/m), uint32(rows), pattern*0x63d83595)
+		jx, jy := rnd.Float64(), rnd.Float64()
+		offsets[s] = point{
+			x: (float64(s%m) + (float64(sy)+jx)/float64(rows)) / float64(m),
+			y: (float64(s/m) + (float64(sx)+jy)/float64(m)) / float64(rows),
+		}
+	}
+	return offsets
+}
+
+// 0..l-1 の値 i を p に応じて並べ替える (Kensler, "Correlated Multi-Jittered Sampling")
+func permute(i, l, p uint32) uint32 {
+	w := l - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+	for {
+		i ^= p
+		i *= 0xe170893d
+		i ^= p >> 16
+		i ^= (i & w) >> 4
+		i ^= p >> 8
+		i *= 0x0929eb3f
+		i ^= p >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | p>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < l {
+			break
+		}
+	}
+	return (i + p) % l
+}
+
+// i と p から 0..1 の擬似乱数を作る
+func randFloat(i, p uint32) float64 {
+	i ^= p
+	i ^= i >> 17
+	i ^= i >> 10
+	i *= 0xb36534e5
+	i ^= i >> 12
+	i ^= i >> 21
+	i *= 0x93fc4795
+	i ^= 0xdf6e307f
+	i ^= i >> 17
+	i *= 1 | p>>18
+	return float64(i) / 4294967808.0
+}
+
+// haltonOffsets は Halton 列の先頭 n 点を shift だけ巡回的にずらして返す
+func haltonOffsets(n int, shift point) []point {
+	offsets := make([]point, n)
+	for i := range offsets {
+		x := halton(i+1, 2) + shift.x
+		y := halton(i+1, 3) + shift.y
+		offsets[i] = point{x - math.Floor(x), y - math.Floor(y)}
+	}
+	return offsets
+}
+
+// 基底 base での i 番目の van der Corput 数を返す
+func halton(i, base int) float64 {
+	f, r := 1.0, 0.0
+	for ; i > 0; i /= base {
+		f /= float64(base)
+		r += f * float64(i%base)
+	}
+	return r
+}
+
+// vogelOffsets はピクセルに内接する円の中に、黄金角のらせんに沿って n 点を配置する。
+// rotation はらせん全体の回転角 (ラジアン)。
+func vogelOffsets(n int, rotation float64) []point {
+	golden := math.Pi * (3 - math.Sqrt(5))
+	offsets := make([]point, n)
+	for i := range offsets {
+		r := 0.5 * math.Sqrt((float64(i)+0.5)/float64(n))
+		theta := float64(i)*golden + rotation
+		offsets[i] = point{0.5 + r*math.Cos(theta), 0.5 + r*math.Sin(theta)}
+	}
+	return offsets
+}
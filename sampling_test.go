@@ -0,0 +1,269 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"testing"
+)
+
+func centerOf(points []point) point {
+	var c point
+	for _, p := range points {
+		c.x += p.x / float64(len(points))
+		c.y += p.y / float64(len(points))
+	}
+	return c
+}
+
+func TestSamplesAreCenteredOnPixel(t *testing.T) {
+	for _, exact := range []bool{false, true} {
+		for _, n := range []int{1, 4} {
+			p := testParameters(5, 5)
+			p.RenderOpts.ExactCoordinates = exact
+			g := mustGenerator(t, p)
+			sw, sh := g.samplingStep()
+
+			// 5×5 の画像の中央のピクセルの中心はビューポートの中心 (0, 0)
+			points := g.samplePoints(2, 2, n, sw, sh)
+			if c := centerOf(points); math.Abs(c.x) > 1e-15 || math.Abs(c.y) > 1e-15 {
+				t.Errorf("exact=%v, n=%d: samples are centered on %v, want (0, 0)", exact, n, c)
+			}
+			if n == 1 && exact && points[0] != (point{}) {
+				t.Errorf("exact=%v: single sample at %v, want (0, 0)", exact, points[0])
+			}
+			for _, q := range points {
+				if math.Abs(q.x) > sw || math.Abs(q.y) > sh {
+					t.Errorf("exact=%v, n=%d: sample %v is outside the pixel", exact, n, q)
+				}
+			}
+		}
+	}
+}
+
+func TestStrategiesStayInsidePixel(t *testing.T) {
+	for _, s := range []SamplingStrategy{SamplingCMJ, SamplingHalton, SamplingVogel} {
+		p := testParameters(5, 5)
+		p.RenderOpts.ExactCoordinates = true
+		p.RenderOpts.Sampling = s
+		g := mustGenerator(t, p)
+		sw, sh := g.samplingStep()
+
+		for _, q := range g.samplePoints(2, 2, 16, sw, sh) {
+			if math.Abs(q.x) > sw || math.Abs(q.y) > sh {
+				t.Errorf("strategy %v: sample %v is outside the center pixel", s, q)
+			}
+		}
+	}
+}
+
+func TestCMJOffsetsAreStratified(t *testing.T) {
+	const m = 4
+	g := mustGenerator(t, testParameters(8, 8))
+	offsets := cmjOffsets(m*m, g.randomSource(3, 5))
+
+	// 各点は m×m のセルに1つずつ入り、n×1 と 1×n の細い帯にも1つずつ入る (n-rooks)
+	cells := make(map[[2]int]bool)
+	cols, rows := make(map[int]bool), make(map[int]bool)
+	for _, o := range offsets {
+		if o.x < 0 || o.x >= 1 || o.y < 0 || o.y >= 1 {
+			t.Fatalf("offset %v is outside the unit square", o)
+		}
+		cells[[2]int{int(o.x * m), int(o.y * m)}] = true
+		cols[int(o.x*m*m)] = true
+		rows[int(o.y*m*m)] = true
+	}
+	if len(cells) != m*m || len(cols) != m*m || len(rows) != m*m {
+		t.Errorf("%d cells, %d columns, %d rows are covered; want %d each", len(cells), len(cols), len(rows), m*m)
+	}
+}
+
+func TestCMJIsReproduciblePerSeed(t *testing.T) {
+	offsets := func(seed uint64, px int) []point {
+		p := testParameters(8, 8)
+		p.RenderOpts.Sampling = SamplingCMJ
+		p.RenderOpts.Seed = seed
+		g := mustGenerator(t, p)
+		return cmjOffsets(9, g.randomSource(px, 2))
+	}
+	same := func(a, b []point) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !same(offsets(1, 3), offsets(1, 3)) {
+		t.Error("the same seed and pixel gave different samples")
+	}
+	if same(offsets(1, 3), offsets(2, 3)) {
+		t.Error("different seeds gave the same samples")
+	}
+	if same(offsets(1, 3), offsets(1, 4)) {
+		t.Error("neighboring pixels gave the same samples")
+	}
+}
+
+// 原点を角とする長方形 [0, u)×[0, v) に入る点の割合と面積との差の最大値 (格子上で近似したスター・ディスクレパンシー)
+func starDiscrepancy(points []point) float64 {
+	const grid = 32
+	var d float64
+	for i := 1; i <= grid; i++ {
+		for j := 1; j <= grid; j++ {
+			u, v := float64(i)/grid, float64(j)/grid
+			var inside int
+			for _, p := range points {
+				if p.x < u && p.y < v {
+					inside++
+				}
+			}
+			d = math.Max(d, math.Abs(float64(inside)/float64(len(points))-u*v))
+		}
+	}
+	return d
+}
+
+func TestHaltonOffsetsAreLowDiscrepancy(t *testing.T) {
+	for _, k := range []int{16, 64} {
+		offsets := haltonOffsets(k, point{})
+
+		// 同じ数の擬似乱数の点と比べる
+		var random float64
+		const trials = 8
+		for seed := range trials {
+			rnd := &hashSource{hash: pixelHash(seed, k, 1)}
+			points := make([]point, k)
+			for i := range points {
+				points[i] = point{rnd.Float64(), rnd.Float64()}
+			}
+			random += starDiscrepancy(points) / trials
+		}
+		if d := starDiscrepancy(offsets); d >= random/2 {
+			t.Errorf("discrepancy of the first %d Halton points = %g, random points = %g", k, d, random)
+		}
+
+		// 先頭の k 点は点の総数によらず同じ
+		if more := haltonOffsets(2*k, point{}); !slices.Equal(more[:k], offsets) {
+			t.Errorf("the first %d points change with the total count", k)
+		}
+	}
+	if a, b := haltonOffsets(16, point{0.3, 0.7}), haltonOffsets(16, point{0.3, 0.7}); !slices.Equal(a, b) {
+		t.Error("Halton offsets are not deterministic")
+	}
+}
+
+func TestVogelOffsetsAreEvenlySpread(t *testing.T) {
+	const n = 64
+	offsets := vogelOffsets(n, 1.2)
+	if !slices.Equal(offsets, vogelOffsets(n, 1.2)) {
+		t.Error("Vogel offsets are not deterministic")
+	}
+
+	// 点同士が近づきすぎず、同心円の帯にはその面積に比例した数の点が入る
+	spacing := math.Sqrt(math.Pi * 0.25 / n)
+	var rings [4]int
+	for i, p := range offsets {
+		r := math.Hypot(p.x-0.5, p.y-0.5)
+		if r > 0.5 {
+			t.Fatalf("point %v is outside the pixel's inscribed circle", p)
+		}
+		rings[min(int(r*r/0.0625), 3)]++
+		for _, q := range offsets[:i] {
+			if d := math.Hypot(p.x-q.x, p.y-q.y); d < spacing/2 {
+				t.Errorf("points %v and %v are only %g apart", p, q, d)
+			}
+		}
+	}
+	for i, c := range rings {
+		if c < n/4-2 || c > n/4+2 {
+			t.Errorf("ring %d has %d points, want about %d", i, c, n/4)
+		}
+	}
+}
+
+// 常に同じ値を返す乱数源
+type constantSource float64
+
+func (s constantSource) Float64() float64 { return float64(s) }
+
+func TestInjectedRandomSourceCentersCMJSamples(t *testing.T) {
+	p := testParameters(5, 5)
+	p.RenderOpts.Sampling = SamplingCMJ
+	p.RenderOpts.SubPixelSamples = 4
+	p.RenderOpts.ExactCoordinates = true
+	var calls int
+	p.RenderOpts.Random = func(px, py int) RandomSource {
+		calls++
+		return constantSource(0.5)
+	}
+	g := mustGenerator(t, p)
+	sw, sh := g.samplingStep()
+
+	// 4点はそれぞれ、ピクセルを 4×4 に分けた細かいセルの中心に置かれる (n-rooks の配置)
+	for _, q := range g.samplePoints(2, 2, 4, sw, sh) {
+		u, v := (q.x+sw)/(2*sw)*4, (q.y+sh)/(2*sh)*4
+		if math.Abs(u-math.Floor(u)-0.5) > 1e-9 || math.Abs(v-math.Floor(v)-0.5) > 1e-9 {
+			t.Errorf("sample %v is not at a cell center", q)
+		}
+	}
+	if calls == 0 {
+		t.Error("the injected random source was not used")
+	}
+}
+
+func TestBlueNoiseOffsetsAreDeterministicAndSpread(t *testing.T) {
+	// 16×16 のテクスチャ。ずれは 1/16 ずつの層に1つずつ入る。
+	tex := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			tex.SetRGBA(x, y, color.RGBA{R: uint8(16*x + y), G: uint8(16*y + (x*5)%16), A: 255})
+		}
+	}
+	newGenerator := func(seed uint64) *Generator {
+		p := testParameters(32, 32)
+		p.RenderOpts.Sampling = SamplingBlueNoise
+		p.RenderOpts.BlueNoise = tex
+		p.RenderOpts.Seed = seed
+		return mustGenerator(t, p)
+	}
+	g := newGenerator(1)
+	sw, sh := g.samplingStep()
+	// 1点目のピクセル内の位置 (左上が (0, 0)、右下が (1, 1))
+	offset := func(g *Generator, px, py int) point {
+		cx, cy := g.pixelCoord(px, py)
+		q := g.samplePoints(px, py, 4, sw, sh)[0]
+		return point{(q.x-cx)/(2*sw) + 0.5, (q.y-cy)/(2*sh) + 0.5}
+	}
+
+	var offsets []point
+	for py := 0; py < 16; py++ {
+		for px := 0; px < 16; px++ {
+			o := offset(g, px, py)
+			// シードによらず、テクスチャの繰り返しに合わせて同じ配置になる
+			if other := offset(newGenerator(2), px, py); math.Abs(o.x-other.x) > 1e-9 || math.Abs(o.y-other.y) > 1e-9 {
+				t.Fatalf("pixel (%d, %d): offset %v with seed 1, %v with seed 2", px, py, o, other)
+			}
+			if wrapped := offset(g, px+16, py+16); math.Abs(o.x-wrapped.x) > 1e-9 || math.Abs(o.y-wrapped.y) > 1e-9 {
+				t.Fatalf("pixel (%d, %d): offset %v, but %v one texture period away", px, py, o, wrapped)
+			}
+			offsets = append(offsets, o)
+		}
+	}
+
+	var random float64
+	const trials = 8
+	for seed := range trials {
+		rnd := &hashSource{hash: pixelHash(seed, 0, 1)}
+		points := make([]point, len(offsets))
+		for i := range points {
+			points[i] = point{rnd.Float64(), rnd.Float64()}
+		}
+		random += starDiscrepancy(points) / trials
+	}
+	if d := starDiscrepancy(offsets); d >= random/2 {
+		t.Errorf("discrepancy of the offsets across the image = %g, random points = %g", d, random)
+	}
+}
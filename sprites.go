@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// SpriteSheet はアニメーションのフレームを columns 列の格子に詰めた1枚の画像を返す。
+// 各セルはフレームの周囲に padding ピクセルの透明な余白を持ち、フレーム i の左上は
+// ((i%columns)*(w+2*padding)+padding, (i/columns)*(h+2*padding)+padding) になる。
+// ゲームエンジンがセルを均等に切り出せるよう、すべてのフレームは同じ大きさでなければならない。
+func SpriteSheet(frames []*image.RGBA, columns, padding int) (*image.RGBA, error) {
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("%w: no frames", ErrInvalidParameters)
+	}
+	if columns <= 0 || padding < 0 {
+		return nil, fmt.Errorf("%w: invalid sprite sheet layout", ErrInvalidParameters)
+	}
+	size := frames[0].Bounds().Size()
+	for i, f := range frames {
+		if f.Bounds().Size() != size {
+			return nil, fmt.Errorf("%w: frame %d is %v, want %v", ErrInvalidParameters, i, f.Bounds().Size(), size)
+		}
+	}
+
+	cellW, cellH := size.X+2*padding, size.Y+2*padding
+	columns = min(columns, len(frames))
+	rows := (len(frames) + columns - 1) / columns
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*cellW, rows*cellH))
+	for i, f := range frames {
+		at := image.Pt((i%columns)*cellW+padding, (i/columns)*cellH+padding)
+		draw.Draw(sheet, image.Rectangle{Min: at, Max: at.Add(size)}, f, f.Bounds().Min, draw.Src)
+	}
+	return sheet, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSpriteSheetLayout(t *testing.T) {
+	const w, h, columns, padding = 5, 3, 3, 2
+	// フレームごとに違う色で塗り、セルの位置を確かめられるようにする
+	frames := make([]*image.RGBA, 7)
+	for i := range frames {
+		frames[i] = image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				frames[i].SetRGBA(x, y, color.RGBA{R: uint8(10 * (i + 1)), A: 255})
+			}
+		}
+	}
+
+	sheet, err := SpriteSheet(frames, columns, padding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cellW, cellH := w+2*padding, h+2*padding
+	if got, want := sheet.Bounds(), image.Rect(0, 0, columns*cellW, 3*cellH); got != want {
+		t.Fatalf("sheet bounds = %v, want %v", got, want)
+	}
+
+	for y := 0; y < sheet.Bounds().Dy(); y++ {
+		for x := 0; x < sheet.Bounds().Dx(); x++ {
+			var want color.RGBA
+			cx, cy := x%cellW-padding, y%cellH-padding
+			if i := (y/cellH)*columns + x/cellW; i < len(frames) && cx >= 0 && cx < w && cy >= 0 && cy < h {
+				want = frames[i].RGBAAt(cx, cy)
+			}
+			if got := sheet.RGBAAt(x, y); got != want {
+				t.Fatalf("sheet pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestSpriteSheetFewerFramesThanColumns(t *testing.T) {
+	frames := []*image.RGBA{image.NewRGBA(image.Rect(0, 0, 4, 4)), image.NewRGBA(image.Rect(0, 0, 4, 4))}
+	sheet, err := SpriteSheet(frames, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sheet.Bounds(), image.Rect(0, 0, 8, 4); got != want {
+		t.Errorf("sheet bounds = %v, want %v", got, want)
+	}
+}
+
+func TestSpriteSheetRejectsMismatchedFrames(t *testing.T) {
+	frames := []*image.RGBA{image.NewRGBA(image.Rect(0, 0, 4, 4)), image.NewRGBA(image.Rect(0, 0, 4, 5))}
+	if _, err := SpriteSheet(frames, 2, 0); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("SpriteSheet with mismatched frames: err = %v, want ErrInvalidParameters", err)
+	}
+	if _, err := SpriteSheet(nil, 2, 0); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("SpriteSheet with no frames: err = %v, want ErrInvalidParameters", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TileOrder はタイルをレンダリングする順序を表す
+type TileOrder int
+
+const (
+	// 上の行から順に、各行を左から右へ
+	TileOrderRowMajor TileOrder = iota
+	// 画像の中心に近いタイルから順に。プレビューで見たい部分が先に出る。
+	TileOrderCenterOut
+	// ヒルベルト曲線に沿った順。続けて処理するタイル同士が近くなる。
+	TileOrderHilbert
+)
+
+// TileFunc は完成したタイルを受け取る。tile の原点は (0, 0) で、
+// offset は画像全体におけるタイル左上の位置を表す。
+type TileFunc func(offset image.Point, tile *image.RGBA)
+
+// GenerateTiles は画像を tileSize 四方のタイルに分けてレンダリングし、
+// 完成したタイルから順に fn に渡す。fn は複数のゴルーチンから同時に呼ばれることがある。
+// fn が戻るまでそのワーカーは次のタイルに進まないので、処理の遅い fn はレンダリングを遅らせ、
+// 受け渡し待ちのタイルがワーカー数を超えて溜まることはない。
+// 画像全体を必要とする後処理 (ブルームなど) は適用されない。
+// Tiles.Budget を超えたタイルは、残りのピクセルを1サンプルだけで計算して締め切りに間に合わせる。
+// tileSize が 0 の場合は AutoTileSize で決める。
+func (g *Generator) GenerateTiles(ctx context.Context, tileSize int, fn TileFunc) error {
+	if tileSize == 0 {
+		tileSize = g.AutoTileSize(ctx)
+	}
+	if tileSize <= 0 {
+		return fmt.Errorf("%w: invalid tile size", ErrInvalidParameters)
+	}
+
+	done, interior := g.logRender("tiles")
+	tiles := orderTiles(g.tileRects(tileSize), tileSize, g.params.Tiles.Order)
+	err := g.renderTiles(ctx, tiles, fn, interior)
+	done(err)
+	return err
+}
+
+// AutoTileSize を試すタイルの大きさ
+var tileSizeCandidates = []int{16, 32, 64, 128}
+
+// 各候補を何回レンダリングして最も速い時間を取るか
+const tileSizeRuns = 3
+
+// AutoTileSize は画像の中央の最大 256 ピクセル四方を候補の大きさのタイルに分けて実際にレンダリングし、
+// 最も速かったタイルの大きさを返す。速さはキャッシュの大きさや画像の内容で変わるため、
+// 現在のパラメータで測る。各候補は tileSizeRuns 回のうち最も速い時間で比べるが、
+// 他の負荷の影響は避けられないので目安として使う。試しのレンダリングは Logger に送らない。
+// 中断された場合は 64 を返す。
+func (g *Generator) AutoTileSize(ctx context.Context) int {
+	probe := *g
+	probe.params.Logger = nil
+
+	w, h := min(g.params.Size.Width, 256), min(g.params.Size.Height, 256)
+	x0, y0 := (g.params.Size.Width-w)/2, (g.params.Size.Height-h)/2
+	region := image.Rect(x0, y0, x0+w, y0+h)
+
+	best, bestTime := 64, time.Duration(math.MaxInt64)
+	for _, size := range tileSizeCandidates {
+		var tiles []image.Rectangle
+		for y := region.Min.Y; y < region.Max.Y; y += size {
+			for x := region.Min.X; x < region.Max.X; x += size {
+				tiles = append(tiles, image.Rect(x, y, x+size, y+size).Intersect(region))
+			}
+		}
+
+		for range tileSizeRuns {
+			start := time.Now()
+			if err := probe.renderTiles(ctx, tiles, func(image.Point, *image.RGBA) {}, nil); err != nil {
+				return 64
+			}
+			if d := time.Since(start); d < bestTime {
+				best, bestTime = size, d
+			}
+		}
+	}
+	return best
+}
+
+// tiles を並列にレンダリングし、完成したものから fn に渡す。interior が nil でなければサンプルを数える。
+// エラーになったタイルがあれば残りを中断し、最初に見つかったエラーを返す。
+func (g *Generator) renderTiles(ctx context.Context, tiles []image.Rectangle, fn TileFunc, interior *interiorCounter) error {
+	workers := min(g.workers(), len(tiles))
+	jobs := make(chan image.Rectangle)
+	// 各ワーカーは最初のエラーだけを送るので、ワーカー数の大きさで足りる
+	errChan := make(chan error, workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var first error
+			for r := range jobs {
+				tile, err := g.renderTile(ctx, r, interior)
+				if err != nil {
+					if first == nil {
+						first = err
+					}
+					cancel()
+					continue
+				}
+				fn(r.Min, tile)
+			}
+			if first != nil {
+				errChan <- first
+			}
+		}()
+	}
+
+	for _, r := range tiles {
+		jobs <- r
+	}
+	close(jobs)
+	wg.Wait()
+	close(errChan)
+
+	for err := range errChan {
+		if err != nil {
+			return fmt.Errorf("error processing tile: %w", err)
+		}
+	}
+	return nil
+}
+
+// Tile は GenerateTilesTo が送る完成したタイル
+type Tile struct {
+	// 画像全体におけるタイル左上の位置
+	Offset image.Point
+	Image  *image.RGBA
+}
+
+// GenerateTilesTo は GenerateTiles と同じようにレンダリングし、完成したタイルを out に送る。
+// out が一杯の間はワーカーが送信を待つので、受け手が遅ければレンダリングもそれに合わせて遅くなる。
+// 送信待ちの間もコンテキストの中断は効く。out は閉じない。
+func (g *Generator) GenerateTilesTo(ctx context.Context, tileSize int, out chan<- Tile) error {
+	var dropped atomic.Bool
+	err := g.GenerateTiles(ctx, tileSize, func(offset image.Point, tile *image.RGBA) {
+		select {
+		case out <- Tile{Offset: offset, Image: tile}:
+		case <-ctx.Done():
+			dropped.Store(true)
+		}
+	})
+	if err == nil && dropped.Load() {
+		return fmt.Errorf("error sending tile: %w", ctx.Err())
+	}
+	return err
+}
+
+// 画像を覆うタイルの範囲を上から順に返す。右端と下端のタイルは小さくなることがある。
+func (g *Generator) tileRects(tileSize int) []image.Rectangle {
+	bounds := image.Rect(0, 0, g.params.Size.Width, g.params.Size.Height)
+	var rects []image.Rectangle
+	for y := 0; y < bounds.Max.Y; y += tileSize {
+		for x := 0; x < bounds.Max.X; x += tileSize {
+			rects = append(rects, image.Rect(x, y, x+tileSize, y+tileSize).Intersect(bounds))
+		}
+	}
+	return rects
+}
+
+// tiles を order の順に並べ替える。tiles は tileRects が返した行優先の並びでなければならない。
+func orderTiles(tiles []image.Rectangle, tileSize int, order TileOrder) []image.Rectangle {
+	ordered := slices.Clone(tiles)
+	switch order {
+	case TileOrderCenterOut:
+		var bounds image.Rectangle
+		for _, r := range tiles {
+			bounds = bounds.Union(r)
+		}
+		cx, cy := bounds.Min.X+bounds.Max.X, bounds.Min.Y+bounds.Max.Y
+		// 中心からの距離の2乗 (座標を2倍して整数のまま比べる)
+		dist := func(r image.Rectangle) int {
+			dx, dy := r.Min.X+r.Max.X-cx, r.Min.Y+r.Max.Y-cy
+			return dx*dx + dy*dy
+		}
+		slices.SortStableFunc(ordered, func(a, b image.Rectangle) int {
+			return cmp.Compare(dist(a), dist(b))
+		})
+	case TileOrderHilbert:
+		var cols, rows int
+		for _, r := range tiles {
+			cols, rows = max(cols, r.Min.X/tileSize+1), max(rows, r.Min.Y/tileSize+1)
+		}
+		n := 1
+		for n < max(cols, rows) {
+			n *= 2
+		}
+		slices.SortStableFunc(ordered, func(a, b image.Rectangle) int {
+			return cmp.Compare(
+				hilbertIndex(n, a.Min.X/tileSize, a.Min.Y/tileSize),
+				hilbertIndex(n, b.Min.X/tileSize, b.Min.Y/tileSize))
+		})
+	}
+	return ordered
+}
+
+// n×n (n は2の累乗) の格子上の (x, y) がヒルベルト曲線の何番目にあたるかを返す
+func hilbertIndex(n, x, y int) int {
+	d := 0
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry int
+		if x&s != 0 {
+			rx = 1
+		}
+		if y&s != 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		// 次の段のために象限を回転する
+		if ry == 0 {
+			if rx == 1 {
+				x, y = n-1-x, n-1-y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+// 1タイル分のピクセルを処理する
+func (g *Generator) renderTile(ctx context.Context, r image.Rectangle, interior *interiorCounter) (*image.RGBA, error) {
+	tile := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	samplingWidth, samplingHeight := g.samplingStep()
+
+	start := time.Now()
+	var deadline time.Time
+	if budget := g.params.Tiles.Budget; budget > 0 {
+		deadline = start.Add(budget)
+	}
+	coarse := false
+	enc := g.encoder()
+
+	cancel := g.newCancelChecker(ctx)
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			if err := cancel.check(); err != nil {
+				return nil, err
+			}
+			if !coarse && !deadline.IsZero() && time.Now().After(deadline) {
+				coarse = true
+			}
+
+			var c fcolor
+			if coarse {
+				c = g.coarsePixel(px, py, interior)
+			} else {
+				c = g.renderPixel(px, py, renderJob{interior: interior}, samplingWidth, samplingHeight)
+			}
+			tile.SetRGBA(px-r.Min.X, py-r.Min.Y, enc.encode(c, px, py))
+		}
+	}
+	if err := cancel.done(); err != nil {
+		return nil, err
+	}
+	if g.params.Logger != nil {
+		g.log("tile", "rect", r, "duration", time.Since(start), "coarse", coarse)
+	}
+	return tile, nil
+}
+
+// ピクセルを中心の1サンプルだけで、線形光で計算する。
+// タイルの時間切れや、GenerateSupersampled でマスクの外になったピクセルに使う。
+func (g *Generator) coarsePixel(px, py int, interior *interiorCounter) fcolor {
+	x, y := g.pixelCoord(px, py)
+	return g.mandelbrot(g.mapPoint(x, y), interior).toLinear()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/draw"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// GenerateTiles で受け取ったタイルを左上の位置ごとに集める
+func collectTiles(t *testing.T, g *Generator, tileSize int) map[image.Point]*image.RGBA {
+	t.Helper()
+	var mu sync.Mutex
+	tiles := make(map[image.Point]*image.RGBA)
+	err := g.GenerateTiles(context.Background(), tileSize, func(offset image.Point, tile *image.RGBA) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := tiles[offset]; ok {
+			t.Errorf("tile at %v was delivered twice", offset)
+		}
+		tiles[offset] = tile
+	})
+	if err != nil {
+		t.Fatalf("GenerateTiles: %v", err)
+	}
+	return tiles
+}
+
+func TestGenerateTilesDeliversEachTileOnce(t *testing.T) {
+	p := testParameters(50, 37)
+	want := mustGenerate(t, p)
+	tiles := collectTiles(t, mustGenerator(t, p), 16)
+
+	// 右端と下端は小さいタイルになる
+	if len(tiles) != 4*3 {
+		t.Errorf("got %d tiles, want 12", len(tiles))
+	}
+	for y := 0; y < 37; y += 16 {
+		for x := 0; x < 50; x += 16 {
+			tile, ok := tiles[image.Pt(x, y)]
+			if !ok {
+				t.Errorf("no tile at (%d, %d)", x, y)
+				continue
+			}
+			if w, h := min(16, 50-x), min(16, 37-y); tile.Bounds() != image.Rect(0, 0, w, h) {
+				t.Errorf("tile at (%d, %d) has bounds %v, want %dx%d", x, y, tile.Bounds(), w, h)
+			}
+			b := tile.Bounds()
+			for ty := 0; ty < b.Dy(); ty++ {
+				for tx := 0; tx < b.Dx(); tx++ {
+					if got, want := tile.RGBAAt(tx, ty), want.RGBAAt(x+tx, y+ty); got != want {
+						t.Fatalf("pixel (%d, %d) = %v in the tile, %v in Generate", x+tx, y+ty, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRenderTilesReportsErrorsWithFewWorkers(t *testing.T) {
+	p := testParameters(8, 4096)
+	p.RenderOpts.Workers = 2
+	g := mustGenerator(t, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// タイルの数はワーカー数よりずっと多いが、各ワーカーが送るのは最初のエラーだけ
+	tiles := g.tileRects(8)
+	if err := g.renderTiles(ctx, tiles, func(image.Point, *image.RGBA) {}, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("renderTiles error = %v, want context.Canceled", err)
+	}
+}
+
+func TestTileOrders(t *testing.T) {
+	g := mustGenerator(t, testParameters(128, 96))
+	rowMajor := g.tileRects(16)
+
+	for _, order := range []TileOrder{TileOrderRowMajor, TileOrderCenterOut, TileOrderHilbert} {
+		ordered := orderTiles(rowMajor, 16, order)
+		seen := make(map[image.Rectangle]int)
+		for _, r := range ordered {
+			seen[r]++
+		}
+		for _, r := range rowMajor {
+			if seen[r] != 1 {
+				t.Errorf("order %d visits tile %v %d times", order, r, seen[r])
+			}
+		}
+		if len(ordered) != len(rowMajor) {
+			t.Errorf("order %d has %d tiles, want %d", order, len(ordered), len(rowMajor))
+		}
+	}
+
+	// 中心から外へ: 最初のタイルは画像の中心 (64, 48) に接する
+	if first := orderTiles(rowMajor, 16, TileOrderCenterOut)[0]; !image.Rect(48, 32, 80, 64).Intersect(first).Eq(first) {
+		t.Errorf("center-out starts at %v, want a tile touching the center", first)
+	}
+
+	// ヒルベルト曲線: 続くタイルは隣り合う (8×8 の格子)
+	square := mustGenerator(t, testParameters(128, 128)).tileRects(16)
+	hilbert := orderTiles(square, 16, TileOrderHilbert)
+	for i := 1; i < len(hilbert); i++ {
+		d := hilbert[i].Min.Sub(hilbert[i-1].Min)
+		if abs(d.X)+abs(d.Y) != 16 {
+			t.Errorf("Hilbert step %d jumps from %v to %v", i, hilbert[i-1], hilbert[i])
+		}
+	}
+}
+
+func abs(v int) int {
+	return max(v, -v)
+}
+
+func TestGenerateTilesFollowsOrder(t *testing.T) {
+	p := testParameters(64, 64)
+	p.RenderOpts.Workers = 1
+	p.Tiles.Order = TileOrderCenterOut
+	g := mustGenerator(t, p)
+
+	var got []image.Point
+	err := g.GenerateTiles(context.Background(), 16, func(offset image.Point, _ *image.RGBA) {
+		got = append(got, offset)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range orderTiles(g.tileRects(16), 16, TileOrderCenterOut) {
+		if got[i] != r.Min {
+			t.Fatalf("tile %d delivered at %v, want %v", i, got[i], r.Min)
+		}
+	}
+}
+
+func TestTileBudgetFallsBackToCoarseSampling(t *testing.T) {
+	p := testParameters(48, 48)
+	p.Tiles.Budget = time.Nanosecond
+	coarse := collectTiles(t, mustGenerator(t, p), 16)
+	p.Tiles.Budget = 0
+	full := collectTiles(t, mustGenerator(t, p), 16)
+	p.RenderOpts.SubPixelSamples = 1
+	single := collectTiles(t, mustGenerator(t, p), 16)
+
+	if len(coarse) != len(full) {
+		t.Fatalf("got %d tiles with a budget, want %d", len(coarse), len(full))
+	}
+	differs := false
+	for offset, tile := range coarse {
+		// 時間切れのタイルは1サンプルで計算したタイルと同じになる
+		if !bytes.Equal(tile.Pix, single[offset].Pix) {
+			t.Errorf("tile at %v differs from single-sample rendering", offset)
+		}
+		differs = differs || !bytes.Equal(tile.Pix, full[offset].Pix)
+	}
+	if !differs {
+		t.Error("budgeted tiles are identical to fully sampled ones")
+	}
+}
+
+func TestGenerateTilesToAppliesBackpressure(t *testing.T) {
+	const workers, buffer = 2, 1
+	p := testParameters(64, 64)
+	p.RenderOpts.Workers = workers
+	// 完成したタイルの数を数え、受け取った数との差 (受け渡し待ちのタイル) の最大値を記録する
+	var rendered, received, peak atomic.Int64
+	p.Logger = loggerFunc(func(event string, _ ...any) {
+		if event != "tile" {
+			return
+		}
+		pending := rendered.Add(1) - received.Load()
+		for {
+			old := peak.Load()
+			if pending <= old || peak.CompareAndSwap(old, pending) {
+				break
+			}
+		}
+	})
+	g := mustGenerator(t, p)
+
+	out := make(chan Tile, buffer)
+	done := make(chan error, 1)
+	go func() {
+		done <- g.GenerateTilesTo(context.Background(), 8, out)
+		close(out)
+	}()
+	var tiles int
+	for range out {
+		time.Sleep(time.Millisecond) // 遅い受け手
+		received.Add(1)
+		tiles++
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if tiles != 64 {
+		t.Errorf("received %d tiles, want 64", tiles)
+	}
+	// 各ワーカーが送信待ちで止まるので、チャネルの大きさとワーカー数を超えて溜まらない
+	if n := peak.Load(); n > buffer+workers+1 {
+		t.Errorf("%d tiles were pending at once, want at most %d", n, buffer+workers+1)
+	}
+}
+
+func TestGenerateTilesToCancelsWhileBlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan Tile) // 誰も受け取らない
+	done := make(chan error)
+	go func() { done <- mustGenerator(t, testParameters(64, 64)).GenerateTilesTo(ctx, 8, out) }()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("GenerateTilesTo error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GenerateTilesTo did not return after cancellation")
+	}
+}
+
+func TestAutoTileSize(t *testing.T) {
+	p := testParameters(96, 80)
+	g := mustGenerator(t, p)
+	if size := g.AutoTileSize(context.Background()); !slices.Contains(tileSizeCandidates, size) {
+		t.Errorf("AutoTileSize = %d, want one of %v", size, tileSizeCandidates)
+	}
+
+	// 中断されていれば測らずに既定の大きさを返す
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if size := g.AutoTileSize(ctx); size != 64 {
+		t.Errorf("AutoTileSize with a canceled context = %d, want 64", size)
+	}
+
+	// タイルの大きさ 0 は AutoTileSize で決め、結果は Generate と同じになる
+	want := mustGenerate(t, p)
+	got := image.NewRGBA(want.Bounds())
+	for offset, tile := range collectTiles(t, g, 0) {
+		draw.Draw(got, tile.Bounds().Add(offset), tile, image.Point{}, draw.Src)
+	}
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("tiles rendered with the automatic size differ from Generate")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "math"
+
+// ViewportFitting は points をすべて含むビューポートを持つパラメータを返す。
+// 各辺に外接矩形の marginFraction 倍の余白を取り、幅/高さが aspect になるよう
+// 短い側を中心から広げる。画像の高さも aspect に合わせて設定する。
+// それ以外の値は NewDefaultParameters と同じになる。
+func ViewportFitting(points []complex128, marginFraction float64, aspect float64) Parameters {
+	p := NewDefaultParameters()
+	if len(points) == 0 {
+		return p
+	}
+	if aspect <= 0 {
+		aspect = float64(p.Size.Width) / float64(p.Size.Height)
+	}
+
+	xmin, xmax := real(points[0]), real(points[0])
+	ymin, ymax := imag(points[0]), imag(points[0])
+	for _, z := range points[1:] {
+		xmin, xmax = math.Min(xmin, real(z)), math.Max(xmax, real(z))
+		ymin, ymax = math.Min(ymin, imag(z)), math.Max(ymax, imag(z))
+	}
+
+	w, h := xmax-xmin, ymax-ymin
+	if w == 0 && h == 0 {
+		// 点が1つしかない場合は既定のビューポートの幅を使う
+		w = p.ViewPort.XMax - p.ViewPort.XMin
+	}
+	w *= 1 + 2*marginFraction
+	h *= 1 + 2*marginFraction
+
+	if w/aspect > h {
+		h = w / aspect
+	} else {
+		w = h * aspect
+	}
+
+	cx, cy := (xmin+xmax)/2, (ymin+ymax)/2
+	p.ViewPort.XMin, p.ViewPort.XMax = cx-w/2, cx+w/2
+	p.ViewPort.YMin, p.ViewPort.YMax = cy-h/2, cy+h/2
+	p.Size.Height = max(1, int(math.Round(float64(p.Size.Width)/aspect)))
+	return p
+}
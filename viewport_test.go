@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestViewportFitting(t *testing.T) {
+	points := []complex128{complex(-0.75, 0.1), complex(-0.1, 0.65), complex(-0.5, 0.3)}
+	const margin, aspect = 0.1, 1.5
+	p := ViewportFitting(points, margin, aspect)
+	vp := p.ViewPort
+
+	// 外接矩形は幅 0.65、高さ 0.55
+	mx, my := margin*0.65, margin*0.55
+	for _, z := range points {
+		if real(z)-vp.XMin < mx-1e-12 || vp.XMax-real(z) < mx-1e-12 ||
+			imag(z)-vp.YMin < my-1e-12 || vp.YMax-imag(z) < my-1e-12 {
+			t.Errorf("point %v is not inside %+v with margin (%g, %g)", z, vp, mx, my)
+		}
+	}
+	if got := (vp.XMax - vp.XMin) / (vp.YMax - vp.YMin); math.Abs(got-aspect) > 1e-9 {
+		t.Errorf("viewport aspect = %g, want %g", got, aspect)
+	}
+	if got := float64(p.Size.Width) / float64(p.Size.Height); math.Abs(got-aspect) > 0.01 {
+		t.Errorf("image aspect = %g, want %g", got, aspect)
+	}
+	if _, err := NewGenerator(p); err != nil {
+		t.Errorf("fitted parameters are invalid: %v", err)
+	}
+}
+
+func TestViewportFittingSinglePoint(t *testing.T) {
+	p := ViewportFitting([]complex128{complex(0.3, -0.2)}, 0, 1)
+	vp := p.ViewPort
+	if cx, cy := (vp.XMin+vp.XMax)/2, (vp.YMin+vp.YMax)/2; math.Abs(cx-0.3) > 1e-12 || math.Abs(cy+0.2) > 1e-12 {
+		t.Errorf("viewport is centered on (%g, %g), want (0.3, -0.2)", cx, cy)
+	}
+	if vp.XMax <= vp.XMin || vp.YMax <= vp.YMin {
+		t.Errorf("viewport %+v is degenerate", vp)
+	}
+}